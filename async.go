@@ -0,0 +1,164 @@
+// Copyright (c) 2022 mobus sunsc0220@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"context"
+	"sync"
+)
+
+// AppendFuture is the pending result of WriteAsync.
+type AppendFuture struct {
+	data  []byte
+	index uint64
+	err   error
+	done  chan struct{}
+}
+
+// Done is closed once the record is committed or has failed.
+func (f *AppendFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the future resolves and returns the index assigned to
+// the record and the error of its commit. When only the sync failed the
+// index is set along with the error.
+func (f *AppendFuture) Wait() (uint64, error) {
+	<-f.done
+	return f.index, f.err
+}
+
+func (f *AppendFuture) resolve(index uint64, err error) {
+	f.data = nil
+	f.index = index
+	f.err = err
+	close(f.done)
+}
+
+// WriteAsync queues data for appending and returns at once. Queued records
+// are written in order by a background goroutine that commits whatever
+// has accumulated as one batch, with a single sync under the active sync
+// policy, and then resolves their futures. Queued records count against
+// the pending limits, WriteAsync waits for room like Write does.
+func (l *Log) WriteAsync(data []byte) *AppendFuture {
+	f := &AppendFuture{data: data, done: make(chan struct{})}
+	if l.opts.ReadOnly {
+		f.resolve(0, ErrReadOnly)
+		return f
+	}
+	if uint64(len(data))+IndexSize+RecordSize >= RecordMaxSize {
+		f.resolve(0, ErrOutOfRecordSize)
+		return f
+	}
+	err := l.pending.acquire(context.Background(), l.opts, 1, frameSize(len(data)))
+	if err != nil {
+		f.resolve(0, err)
+		return f
+	}
+	if !l.async.push(l, f) {
+		l.pending.release(1, frameSize(len(data)))
+	}
+	return f
+}
+
+// asyncWriter is the queue and goroutine behind WriteAsync.
+type asyncWriter struct {
+	mu      sync.Mutex
+	queue   []*AppendFuture
+	wake    chan struct{}
+	exit    chan struct{}
+	started bool
+	stopped bool
+}
+
+// push queues f, it resolves f with ErrClosed and returns false once the
+// writer is stopped.
+func (a *asyncWriter) push(l *Log, f *AppendFuture) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stopped {
+		f.resolve(0, ErrClosed)
+		return false
+	}
+	if !a.started {
+		a.started = true
+		a.wake = make(chan struct{}, 1)
+		a.exit = make(chan struct{})
+		go a.run(l)
+	}
+	a.queue = append(a.queue, f)
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// stop flushes the queue and waits for the goroutine to exit, later
+// calls to WriteAsync fail with ErrClosed.
+func (a *asyncWriter) stop() {
+	a.mu.Lock()
+	started := a.started && !a.stopped
+	a.stopped = true
+	a.mu.Unlock()
+	if !started {
+		return
+	}
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+	<-a.exit
+}
+
+func (a *asyncWriter) run(l *Log) {
+	defer close(a.exit)
+	var b Batch
+	for range a.wake {
+		a.mu.Lock()
+		queue := a.queue
+		a.queue = nil
+		stopped := a.stopped
+		a.mu.Unlock()
+
+		if len(queue) > 0 {
+			b.Reset()
+			for _, f := range queue {
+				b.Add(f.data)
+			}
+			var first uint64
+			recs, err := l.prepare(&b)
+			if err == nil {
+				l.wmu.Lock()
+				first, _, err = l.appendBatch(recs, b.size)
+				l.wmu.Unlock()
+			}
+			if err == nil {
+				err = l.commit(context.Background())
+			}
+			l.pending.release(len(queue), b.size)
+			for i, f := range queue {
+				var index uint64
+				if first > 0 {
+					index = first + uint64(i)
+				}
+				f.resolve(index, err)
+			}
+		}
+		if stopped {
+			return
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package wal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalWriteAsync(t *testing.T) {
+	l, _ := tempLog(t, nil)
+
+	var futures []*AppendFuture
+	for i := uint64(1); i <= uint64(len(tables)); i++ {
+		futures = append(futures, l.WriteAsync(tables[i].data))
+	}
+	for i, f := range futures {
+		idx, err := f.Wait()
+		assert.Equal(t, nil, err, "async write")
+		assert.Equal(t, uint64(i+1), idx, "in order")
+		d, _ := l.Read(idx)
+		assert.Equal(t, tables[idx].data, d, "async write")
+	}
+
+	pending := l.WriteAsync([]byte("flushed on close"))
+	l.Close()
+	select {
+	case <-pending.Done():
+	default:
+		t.Error("pending write not flushed by Close")
+	}
+	idx, err := pending.Wait()
+	assert.Equal(t, nil, err, "flushed on close")
+	assert.Equal(t, uint64(len(tables))+1, idx, "flushed on close")
+
+	_, err = l.WriteAsync([]byte("closed")).Wait()
+	assert.Equal(t, ErrClosed, err, "closed")
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2022 mobus sunsc0220@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"context"
+	"encoding/binary"
+)
+
+// Batch collects records that are written to the log atomically.
+type Batch struct {
+	recs []Record
+	size int
+}
+
+// Add appends data to the batch.
+func (b *Batch) Add(data []byte) {
+	b.add(RecordIns, data, nil)
+}
+
+// AddWithMeta appends data with metadata attributes, see Log.WriteWithMeta.
+func (b *Batch) AddWithMeta(data []byte, attrs map[string]string) {
+	b.add(RecordIns, data, attrs)
+}
+
+// AddTombstone appends a tombstone for the record idx to the batch, see
+// Log.WriteTombstone. idx is not checked, it may refer to a record of
+// the batch itself.
+func (b *Batch) AddTombstone(idx uint64) {
+	b.add(RecordDel, binary.BigEndian.AppendUint64(nil, idx), nil)
+}
+
+func (b *Batch) add(op OpType, data []byte, attrs map[string]string) {
+	b.recs = append(b.recs, Record{data: data, op: op, attrs: attrs})
+	b.size += frameSize(len(data))
+	if len(attrs) > 0 {
+		b.size += attrsSize(attrs)
+	}
+}
+
+// Len returns the number of records in the batch.
+func (b *Batch) Len() int {
+	return len(b.recs)
+}
+
+// Reset empties the batch so it can be reused.
+func (b *Batch) Reset() {
+	b.recs = b.recs[:0]
+	b.size = 0
+}
+
+// WriteBatch frames all records of b contiguously and commits them with a
+// single header update, after a crash either the whole batch is visible
+// or none of it. It returns the index range assigned to the batch.
+func (l *Log) WriteBatch(b *Batch) (first, last uint64, err error) {
+	return l.WriteBatchContext(context.Background(), b)
+}
+
+// WriteBatchContext is WriteBatch bounded by ctx, like WriteContext.
+func (l *Log) WriteBatchContext(ctx context.Context, b *Batch) (first, last uint64, err error) {
+	err = ctx.Err()
+	if err != nil {
+		return 0, 0, err
+	}
+	if b == nil || len(b.recs) == 0 {
+		return 0, 0, ErrEmptyBatch
+	}
+	err = l.pending.acquire(ctx, l.opts, len(b.recs), b.size)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer l.pending.release(len(b.recs), b.size)
+	recs, err := l.prepare(b)
+	if err != nil {
+		return 0, 0, err
+	}
+	l.wmu.Lock()
+	first, last, err = l.appendBatch(recs, b.size)
+	l.wmu.Unlock()
+	if err != nil {
+		return 0, 0, err
+	}
+	return first, last, l.commit(ctx)
+}
+
+// prepare compresses the records of b, before wmu is taken.
+func (l *Log) prepare(b *Batch) ([]*Record, error) {
+	version := l.writer.Version()
+	recs := make([]*Record, len(b.recs))
+	for i := range b.recs {
+		r, err := l.compress(&b.recs[i], version)
+		if err != nil {
+			return nil, err
+		}
+		recs[i] = r
+	}
+	return recs, nil
+}
+
+// appendBatch assigns the next indexes to the prepared records recs and
+// appends them, size is about the size of their frames. The caller holds
+// wmu.
+func (l *Log) appendBatch(recs []*Record, size int) (first, last uint64, err error) {
+	first = l.lastIndex.Load() + 1
+	frames := make([]byte, 0, size)
+	idxs := make([]uint64, len(recs))
+	prev := l.prevIndex()
+	for i, r := range recs {
+		r.index = first + uint64(i)
+		idxs[i] = r.index
+		r.prev = prev
+		prev = r.index
+		f, err := l.frame(r)
+		if err != nil {
+			return 0, 0, err
+		}
+		frames = append(frames, f...)
+	}
+	last = first + uint64(len(recs)) - 1
+	err = l.append(frames, idxs)
+	if err != nil {
+		return 0, 0, err
+	}
+	return first, last, nil
+}
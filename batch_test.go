@@ -0,0 +1,40 @@
+package wal
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalWriteBatch(t *testing.T) {
+	l, path := tempLog(t, nil)
+	l.Write(tables[1].data)
+
+	_, _, err := l.WriteBatch(&Batch{})
+	assert.Equal(t, ErrEmptyBatch, err, "empty batch")
+
+	b := &Batch{}
+	for i := uint64(2); i <= uint64(len(tables)); i++ {
+		b.Add(tables[i].data)
+	}
+	first, last, err := l.WriteBatch(b)
+	assert.Equal(t, nil, err, "write batch")
+	assert.Equal(t, uint64(2), first, "first")
+	assert.Equal(t, uint64(len(tables)), last, "last")
+	for i := first; i <= last; i++ {
+		d, err := l.Read(i)
+		assert.Equal(t, nil, err, fmt.Sprintf("index: %d ", i))
+		assert.Equal(t, tables[i].data, d, fmt.Sprintf("index: %d ", i))
+	}
+
+	// crash after the frames were written but before the header update
+	r := &Record{index: last + 1, data: []byte("lost")}
+	frames, _ := r.Marshal()
+	l.writer.Write(frames)
+	l.Close()
+
+	l = openLog(t, path, nil)
+	items, _ := l.writer.Items()
+	assert.Equal(t, len(tables), len(items), "uncommitted batch dropped")
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2022 mobus sunsc0220@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+)
+
+// bloomRecords is how many records a segment of the bloom filters covers.
+const bloomRecords = 1 << 14
+
+// blooms holds bloom filters over the indexes of the records of a log, see
+// Option.BloomFalsePositive. Each segment covers a run of bloomRecords
+// records in index order and is sealed once full, a lookup only probes
+// the segment whose index range holds the index. The filters live in
+// memory, Open rebuilds them from the frames.
+//
+// Writers hold wmu. They set the bits of a record before its index is
+// published, so a reader that finds the index in range also finds its
+// bits. Segments are replaced as a whole on truncation.
+type blooms struct {
+	p    float64
+	segs atomic.Pointer[[]*bloomSegment]
+}
+
+type bloomSegment struct {
+	first uint64
+	last  atomic.Uint64
+	n     int
+	k     uint64
+	bits  []atomic.Uint64
+}
+
+func newBloomSegment(first uint64, p float64) *bloomSegment {
+	m := math.Ceil(-bloomRecords * math.Log(p) / (math.Ln2 * math.Ln2))
+	words := (uint64(m) + 63) / 64
+	k := uint64(math.Round(float64(words*64) / bloomRecords * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	s := &bloomSegment{first: first, k: k, bits: make([]atomic.Uint64, words)}
+	s.last.Store(first)
+	return s
+}
+
+// probe calls fn with the word and bit of each of the k positions of idx,
+// until fn returns false.
+func (s *bloomSegment) probe(idx uint64, fn func(w int, bit uint64) bool) {
+	h1 := mix64(idx)
+	h2 := mix64(h1) | 1
+	m := uint64(len(s.bits)) * 64
+	for i := uint64(0); i < s.k; i++ {
+		pos := (h1 + i*h2) % m
+		if !fn(int(pos/64), 1<<(pos%64)) {
+			return
+		}
+	}
+}
+
+// mix64 is the finalizer of SplitMix64.
+func mix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// init enables the filters with the false positive rate p, 0 leaves them
+// disabled.
+func (b *blooms) init(p float64) error {
+	if p < 0 || p >= 1 {
+		return ErrBloomRate
+	}
+	b.p = p
+	b.segs.Store(&[]*bloomSegment{})
+	return nil
+}
+
+// add adds idx, which is greater than every index added before.
+func (b *blooms) add(idx uint64) {
+	if b.p == 0 {
+		return
+	}
+	segs := *b.segs.Load()
+	if len(segs) == 0 || segs[len(segs)-1].n == bloomRecords {
+		segs = append(segs[:len(segs):len(segs)], newBloomSegment(idx, b.p))
+		b.segs.Store(&segs)
+	}
+	s := segs[len(segs)-1]
+	s.probe(idx, func(w int, bit uint64) bool {
+		s.bits[w].Store(s.bits[w].Load() | bit)
+		return true
+	})
+	s.n++
+	s.last.Store(idx)
+}
+
+// has reports whether idx may have been added, it is always true while
+// the filters are disabled.
+func (b *blooms) has(idx uint64) bool {
+	if b.p == 0 {
+		return true
+	}
+	segs := *b.segs.Load()
+	i := sort.Search(len(segs), func(i int) bool { return segs[i].first > idx }) - 1
+	if i < 0 {
+		return false
+	}
+	s := segs[i]
+	if idx > s.last.Load() {
+		return false
+	}
+	found := true
+	s.probe(idx, func(w int, bit uint64) bool {
+		found = s.bits[w].Load()&bit != 0
+		return found
+	})
+	return found
+}
+
+// truncateFront drops the segments that only hold indexes below idx.
+func (b *blooms) truncateFront(idx uint64) {
+	if b.p == 0 {
+		return
+	}
+	segs := *b.segs.Load()
+	i := 0
+	for i < len(segs) && segs[i].last.Load() < idx {
+		i++
+	}
+	rest := append([]*bloomSegment(nil), segs[i:]...)
+	b.segs.Store(&rest)
+}
+
+// truncateBack drops the indexes above idx. The bits of the dropped
+// records of the last segment kept stay set, they only cost false
+// positives.
+func (b *blooms) truncateBack(idx uint64) {
+	if b.p == 0 {
+		return
+	}
+	segs := *b.segs.Load()
+	i := sort.Search(len(segs), func(i int) bool { return segs[i].first > idx })
+	rest := append([]*bloomSegment(nil), segs[:i]...)
+	if i > 0 && rest[i-1].last.Load() > idx {
+		rest[i-1].last.Store(idx)
+	}
+	b.segs.Store(&rest)
+}
+
+// reset rebuilds the filters from the frames of items up to last.
+func (b *blooms) reset(items []*Item, last uint64) {
+	if b.p == 0 {
+		return
+	}
+	b.segs.Store(&[]*bloomSegment{})
+	for _, item := range items {
+		if item.index > last {
+			break
+		}
+		b.add(item.index)
+	}
+}
@@ -0,0 +1,109 @@
+package wal
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBloom(t *testing.T) {
+	b := &blooms{}
+	assert.Equal(t, ErrBloomRate, b.init(1), "rate of 1")
+	assert.Equal(t, ErrBloomRate, b.init(-0.1), "negative rate")
+	assert.Equal(t, nil, b.init(0), "disabled")
+	b.add(2)
+	assert.Equal(t, true, b.has(3), "disabled filters hold everything")
+
+	assert.Equal(t, nil, b.init(0.01), "enabled")
+	const n = 3 * bloomRecords
+	for i := uint64(1); i <= n; i++ {
+		b.add(i * 2)
+	}
+	assert.Equal(t, 3, len(*b.segs.Load()), "segments")
+	positives := 0
+	for i := uint64(1); i <= n; i++ {
+		assert.Equal(t, true, b.has(i*2), "no false negatives")
+		if b.has(i*2 + 1) {
+			positives++
+		}
+	}
+	assert.Equal(t, true, positives < n/50, "false positive rate")
+	assert.Equal(t, false, b.has(1), "below the first segment")
+	assert.Equal(t, false, b.has(2*n+2), "above the last segment")
+
+	b.truncateFront(2*bloomRecords + 4)
+	assert.Equal(t, 2, len(*b.segs.Load()), "segment dropped")
+	assert.Equal(t, false, b.has(2), "dropped")
+	assert.Equal(t, true, b.has(2*bloomRecords+4), "kept")
+	b.truncateBack(2*bloomRecords + 8)
+	assert.Equal(t, 1, len(*b.segs.Load()), "segment dropped from the back")
+	assert.Equal(t, false, b.has(2*bloomRecords+10), "above the tail")
+	b.add(2*bloomRecords + 10)
+	assert.Equal(t, true, b.has(2*bloomRecords+10), "added after the truncation")
+}
+
+func TestWalBloom(t *testing.T) {
+	_, err := Open(filepath.Join(t.TempDir(), "wal"), &Option{BloomFalsePositive: 2})
+	assert.Equal(t, ErrBloomRate, err, "invalid rate")
+
+	opts := &Option{AllowGaps: true, NoSync: true, BloomFalsePositive: 0.01}
+	l, path := tempLog(t, opts)
+	for i := uint64(1); i <= 1000; i++ {
+		l.WriteAt(i*2, tables[1].data)
+	}
+	b := &Batch{}
+	b.Add(tables[2].data)
+	l.WriteBatch(b)
+	check := func(t *testing.T, l *Log, first, last uint64, msg string) {
+		t.Helper()
+		positives := 0
+		for i := first; i <= last; i++ {
+			_, err := l.Read(i)
+			if i%2 == 0 || i == 2001 {
+				assert.Equal(t, nil, err, msg)
+				continue
+			}
+			assert.Equal(t, ErrNotFound, err, msg)
+			if l.bloom.has(i) {
+				positives++
+			}
+		}
+		assert.Equal(t, true, positives < 20, msg)
+	}
+	check(t, l, 1, 2001, "written")
+	l.TruncateFront(100)
+	check(t, l, 100, 2001, "truncated front")
+	l.TruncateBack(1500)
+	check(t, l, 100, 1500, "truncated back")
+	l.Close()
+
+	l = openLog(t, path, opts)
+	check(t, l, 100, 1500, "reopened")
+	m, err := l.ReadBatch(101, 102, 103)
+	assert.Equal(t, nil, err, "batch")
+	assert.Equal(t, map[uint64][]byte{102: tables[1].data}, m, "batch")
+}
+
+func TestWalBloomFailedWrite(t *testing.T) {
+	opts := &Option{AllowGaps: true, NoSync: true, BloomFalsePositive: 0.01}
+	l, _ := tempLog(t, opts)
+	b := &Batch{}
+	for i := 0; i < bloomRecords; i++ {
+		b.Add(tables[1].data)
+	}
+	_, _, err := l.WriteBatch(b)
+	assert.Equal(t, nil, err, "batch")
+	// a record past the end of the mapping fails once framed
+	f := l.writer.(*UnixFile)
+	mmpSize := f.mmpSize
+	f.mmpSize = uint64(f.Size()) + 1<<10
+	err = l.WriteAt(bloomRecords+100, make([]byte, 1<<11))
+	assert.Equal(t, ErrOutOfSize, err, "failed write")
+	f.mmpSize = mmpSize
+	assert.Equal(t, false, l.bloom.has(bloomRecords+100), "failed write not added")
+	assert.Equal(t, nil, l.WriteAt(bloomRecords+50, []byte("y")), "written")
+	data, err := l.Read(bloomRecords + 50)
+	assert.Equal(t, nil, err, "read after a failed write")
+	assert.Equal(t, []byte("y"), data, "read after a failed write")
+}
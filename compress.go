@@ -0,0 +1,191 @@
+// Copyright (c) 2022 mobus sunsc0220@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Compressor compresses the data of records. Its ID is stored in every
+// frame it compressed and picks it again for reading, so an ID must keep
+// meaning the same format for as long as such frames exist.
+type Compressor interface {
+	ID() byte
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// IDs of the compressors shipped with the package, IDs from 128 up are
+// left to users.
+const (
+	CompressDeflate byte = 1
+	CompressGzip    byte = 2
+)
+
+var (
+	Deflate Compressor = deflateCompressor{}
+	Gzip    Compressor = gzipCompressor{}
+)
+
+var compressors = struct {
+	sync.RWMutex
+	m map[byte]Compressor
+}{m: map[byte]Compressor{
+	CompressDeflate: Deflate,
+	CompressGzip:    Gzip,
+}}
+
+// RegisterCompressor makes c available for reading and writing records.
+// It panics if the ID of c is 0 or already taken.
+func RegisterCompressor(c Compressor) {
+	compressors.Lock()
+	defer compressors.Unlock()
+	id := c.ID()
+	if id == 0 {
+		panic("wal: compressor ID 0 is reserved")
+	}
+	if _, ok := compressors.m[id]; ok {
+		panic(fmt.Sprintf("wal: compressor ID %d registered twice", id))
+	}
+	compressors.m[id] = c
+}
+
+func lookupCompressor(id byte) Compressor {
+	compressors.RLock()
+	defer compressors.RUnlock()
+	return compressors.m[id]
+}
+
+// compress returns r with its data compressed under Option.Compression,
+// or r itself when the data is too small or does not shrink.
+func (l *Log) compress(r *Record, version uint64) (*Record, error) {
+	c := l.opts.Compression
+	min := l.opts.CompressMin
+	if min == 0 {
+		min = defaultCompressMin
+	}
+	if uint64(len(r.data))+IndexSize+RecordSize >= RecordMaxSize {
+		return nil, ErrOutOfRecordSize
+	}
+	if c == nil || version < formatV2 || len(r.data) < min {
+		return r, nil
+	}
+	data, err := c.Compress(r.data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) >= len(r.data) {
+		return r, nil
+	}
+	cr := *r
+	cr.data = data
+	cr.comp = c.ID()
+	return &cr, nil
+}
+
+// frame marshals r for the file, encrypting its data as configured. r has
+// been through compress, which runs before wmu is taken, while sealing
+// needs the index assigned under wmu.
+func (l *Log) frame(r *Record) ([]byte, error) {
+	version := l.writer.Version()
+	r, err := l.seal(r, version)
+	if err != nil {
+		return nil, err
+	}
+	b, err := r.marshal(version)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+type deflateCompressor struct{}
+
+func (deflateCompressor) ID() byte {
+	return CompressDeflate
+}
+
+func (deflateCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	_, err := w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (deflateCompressor) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return readAll(r)
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) ID() byte {
+	return CompressGzip
+}
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readAll(r)
+}
+
+// readAll reads r up to the size limit of a record.
+func readAll(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, RecordMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) >= RecordMaxSize {
+		return nil, ErrOutOfRecordSize
+	}
+	return data, nil
+}
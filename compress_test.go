@@ -0,0 +1,100 @@
+package wal
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// upperCompressor is a reversible stand-in that only shrinks runs of 'a'.
+type upperCompressor struct{}
+
+func (upperCompressor) ID() byte { return 200 }
+
+func (upperCompressor) Compress(data []byte) ([]byte, error) {
+	return bytes.ReplaceAll(data, []byte("aaaa"), []byte("A")), nil
+}
+
+func (upperCompressor) Decompress(data []byte) ([]byte, error) {
+	return bytes.ReplaceAll(data, []byte("A"), []byte("aaaa")), nil
+}
+
+// unknownCompressor is never registered.
+type unknownCompressor struct{ upperCompressor }
+
+func (unknownCompressor) ID() byte { return 202 }
+
+func init() {
+	RegisterCompressor(upperCompressor{})
+}
+
+func TestWalCompression(t *testing.T) {
+	_, err := Open(filepath.Join(t.TempDir(), "wal"), &Option{Compression: unknownCompressor{}})
+	assert.Equal(t, ErrCompressor, err, "not registered")
+
+	json := bytes.Repeat([]byte(`{"name":"aaaaaaaa","count":1},`), 100)
+	var path string
+	for _, c := range []Compressor{Deflate, Gzip, upperCompressor{}} {
+		var l *Log
+		l, path = tempLog(t, &Option{Compression: c, NoCopy: c == Gzip})
+		l.Write(json)
+		assert.Equal(t, true, l.writer.Size() < HeaderSize+int64(len(json)), "compressed")
+		size := l.writer.Size()
+		l.Write(tables[1].data)
+		assert.Equal(t, int64(frameSize(len(tables[1].data))), l.writer.Size()-size, "below the threshold")
+		l.WriteWithMeta(bytes.Repeat([]byte("a"), 400), map[string]string{"k": "v"})
+
+		data, err := l.Read(1)
+		assert.Equal(t, nil, err, "read")
+		assert.Equal(t, json, data, "decompressed")
+		data, _ = l.Read(2)
+		assert.Equal(t, tables[1].data, data, "plain")
+		e, _ := l.ReadEntry(3)
+		assert.Equal(t, bytes.Repeat([]byte("a"), 400), e.Data, "decompressed with meta")
+		assert.Equal(t, map[string]string{"k": "v"}, e.Meta, "meta")
+		l.Close()
+	}
+
+	// reading needs no option, the frame names its compressor
+	l := openLog(t, path, nil)
+	data, _ := l.Read(1)
+	assert.Equal(t, json, data, "read without the option")
+}
+
+func TestWalCompressMin(t *testing.T) {
+	l, _ := tempLog(t, &Option{Compression: upperCompressor{}, CompressMin: 8})
+	grown := func(data []byte) int64 {
+		size := l.writer.Size()
+		if err := l.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		return l.writer.Size() - size
+	}
+	assert.Equal(t, int64(frameSize(7)), grown([]byte("aaaaaaa")), "below CompressMin")
+	assert.Equal(t, int64(frameSize(2)+1), grown([]byte("aaaaaaaa")), "at CompressMin")
+	assert.Equal(t, int64(frameSize(8)), grown([]byte("abcdefgh")), "stored raw when it does not shrink")
+	for i, want := range []string{"aaaaaaa", "aaaaaaaa", "abcdefgh"} {
+		data, err := l.Read(uint64(i + 1))
+		assert.Equal(t, nil, err, "read")
+		assert.Equal(t, []byte(want), data, "data")
+	}
+}
+
+func TestWalCompressOutsideLock(t *testing.T) {
+	l, release := holdLog(t, &Option{CompressMin: 2})
+	done := make(chan error)
+	go func() {
+		done <- l.Write([]byte("x"))
+	}()
+	select {
+	case err := <-done:
+		assert.Equal(t, nil, err, "write below CompressMin")
+	case <-time.After(10 * time.Second):
+		t.Fatal("a write waited for the compression of another")
+	}
+	release()
+	assert.Equal(t, uint64(2), l.LastIndex(), "both written")
+}
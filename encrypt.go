@@ -0,0 +1,124 @@
+// Copyright (c) 2022 mobus sunsc0220@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+)
+
+// KeyProvider supplies the AES keys of Option.Encryption, 16, 24 or 32
+// bytes long. Each frame stores the ID of its key, so keys can be rotated
+// by changing the current one as long as the old ones stay available.
+type KeyProvider interface {
+	// CurrentKey returns the key new records are sealed with
+	CurrentKey() (id uint32, key []byte, err error)
+	// Key returns the key with the given ID
+	Key(id uint32) ([]byte, error)
+}
+
+// KeyRing is a KeyProvider holding its keys in memory.
+type KeyRing struct {
+	Current uint32
+	Keys    map[uint32][]byte
+}
+
+func (k *KeyRing) CurrentKey() (uint32, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+func (k *KeyRing) Key(id uint32) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, ErrDecrypt
+	}
+	return key, nil
+}
+
+// seal returns a copy of r with its data sealed under the current key.
+//
+// Every frame gets a random 96 bit nonce, so nonces stay apart across
+// logs sharing a key and across indexes written again after TruncateBack.
+// The index is authenticated along with the type and the attributes.
+func (l *Log) seal(r *Record, version uint64) (*Record, error) {
+	keys := l.opts.Encryption
+	if keys == nil {
+		return r, nil
+	}
+	if version < formatV2 {
+		return nil, ErrOldFormat
+	}
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sr := *r
+	sr.sealed = true
+	sr.key = id
+	sr.nonce = make([]byte, NonceSize)
+	_, err = io.ReadFull(rand.Reader, sr.nonce)
+	if err != nil {
+		return nil, err
+	}
+	sr.data = aead.Seal(nil, sr.nonce, r.data, sr.aad())
+	return &sr, nil
+}
+
+// open returns the data sealed in r.
+func (r *Record) open(data []byte, keys KeyProvider) ([]byte, error) {
+	if keys == nil {
+		return nil, ErrDecrypt
+	}
+	key, err := keys.Key(r.key)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	d, err := aead.Open(nil, r.nonce, data, r.aad())
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return d, nil
+}
+
+// aad authenticates the index, the type and the attributes of the record
+// along with its data.
+func (r *Record) aad() []byte {
+	a := binary.BigEndian.AppendUint64(nil, r.index)
+	a = append(a, byte(r.op))
+	if len(r.attrs) > 0 {
+		a = appendAttrs(a, r.attrs)
+	}
+	return a
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
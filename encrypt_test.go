@@ -0,0 +1,99 @@
+package wal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalEncryption(t *testing.T) {
+	ring := &KeyRing{Current: 1, Keys: map[uint32][]byte{
+		1: bytes.Repeat([]byte{1}, 32),
+		2: bytes.Repeat([]byte{2}, 16),
+	}}
+	secret := []byte("card number 4111 1111 1111 1111")
+	l, path := tempLog(t, &Option{Encryption: ring, Compression: Deflate, CompressMin: 1})
+	l.Write(secret)
+	ring.Current = 2
+	l.WriteWithMeta(secret, map[string]string{"trace": "t1"})
+	l.Write(secret)
+	l.TruncateBack(2)
+	l.Write(secret)
+	l.Close()
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, false, bytes.Contains(raw, []byte("4111")), "sealed on disk")
+
+	l = openLog(t, path, &Option{Encryption: ring, NoCopy: true})
+	for i := uint64(1); i <= 3; i++ {
+		data, err := l.Read(i)
+		assert.Equal(t, nil, err, "read")
+		assert.Equal(t, secret, data, "opened")
+	}
+	e, _ := l.ReadEntry(2)
+	assert.Equal(t, map[string]string{"trace": "t1"}, e.Meta, "meta")
+	raw, _ = os.ReadFile(path)
+	// key(4B)+nonce(12B) follow flags(1B) and comp(1B)
+	nonces := map[string]bool{}
+	items, _ := l.writer.Items()
+	for _, it := range items {
+		off := it.offset + RecordSize + IndexSize + FlagSize + 1 + 4
+		nonces[string(raw[off:off+NonceSize])] = true
+	}
+	assert.Equal(t, len(items), len(nonces), "a nonce per frame")
+	l.Close()
+
+	l = openLog(t, path, &Option{Encryption: &KeyRing{Current: 2, Keys: map[uint32][]byte{2: ring.Keys[2]}}})
+	_, err = l.Read(1)
+	assert.Equal(t, ErrDecrypt, err, "rotated out key")
+	data, _ := l.Read(2)
+	assert.Equal(t, secret, data, "current key")
+	l.Close()
+
+	l = openLog(t, path, nil)
+	_, err = l.Read(1)
+	assert.Equal(t, ErrDecrypt, err, "no keys")
+	l.Close()
+
+	// a frame moved to another index does not open
+	raw, _ = os.ReadFile(path)
+	binary.BigEndian.PutUint64(raw[HeaderSize+RecordSize:], 7)
+	frame := raw[HeaderSize : HeaderSize+RecordSize+binary.BigEndian.Uint32(raw[HeaderSize:])]
+	sum := len(frame) - RecordSize - ChecksumSize
+	binary.BigEndian.PutUint32(frame[sum:], crc32.Checksum(frame[:sum], crcTable))
+	if err := os.WriteFile(path, raw, 0664); err != nil {
+		t.Fatal(err)
+	}
+	l = openLog(t, path, &Option{Encryption: ring, ReadOnly: true, RefreshInterval: -1})
+	it, err := l.writer.Item(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = l.writer.ReadRecord(int64(it.offset), it.prev)
+	assert.Equal(t, ErrDecrypt, err, "index authenticated")
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("no entropy") }
+
+func TestWalEncryptionRandError(t *testing.T) {
+	ring := &KeyRing{Current: 1, Keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}}
+	l, _ := tempLog(t, &Option{Encryption: ring})
+	reader := rand.Reader
+	rand.Reader = failingReader{}
+	err := l.Write([]byte("secret"))
+	rand.Reader = reader
+	assert.Equal(t, "no entropy", fmt.Sprint(err), "rand error returned")
+	assert.Equal(t, uint64(0), l.LastIndex(), "nothing written")
+}
@@ -22,4 +22,20 @@ var (
 	ErrFile            = errors.New("error file")
 	ErrNotFound        = errors.New("not found")
 	ErrOutOfRecordSize = errors.New("out of the record max size")
+	ErrEmptyBatch      = errors.New("empty batch")
+	ErrInvalidIndex    = errors.New("invalid index")
+	ErrOutOfOrder      = errors.New("index not greater than the last index")
+	ErrIndexGap        = errors.New("index leaves a gap after the last index")
+	ErrNotSupported    = errors.New("not supported on this platform")
+	ErrClosed          = errors.New("log closed")
+	ErrTruncated       = errors.New("log truncated past the position")
+	ErrReadOnly        = errors.New("log opened read-only")
+	ErrBusy            = errors.New("too many pending writes")
+	ErrOldFormat       = errors.New("not supported by the format version of the file")
+	ErrCompressor      = errors.New("unknown compressor")
+	ErrDecrypt         = errors.New("record cannot be decrypted")
+	ErrVersion         = errors.New("unsupported format version")
+	ErrChecksum        = errors.New("record checksum mismatch")
+	ErrTorn            = errors.New("records torn below the tail of an interrupted truncation")
+	ErrBloomRate       = errors.New("bloom false positive rate not in [0, 1)")
 )
@@ -0,0 +1,304 @@
+// Copyright (c) 2022 mobus sunsc0220@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// Export stream format:
+// magic(4B)+version(4B) followed by frames of
+// index(8B)+length(4B)+flags(1B)+crc32c(4B)+data(NB), and an end frame
+// with index 0. flags are those of a record frame, with flagAttrs data
+// starts with the attributes encoded as in a record frame. Version 1
+// frames have no flags, Import reads them as RecordIns. Version 2 flags
+// only hold the OpType, version 3 added flagAttrs.
+const (
+	streamMagic       = 0x57414c58 // "WALX"
+	streamVersion     = 3
+	streamHeadSize    = 8
+	streamFrameSize   = IndexSize + 9
+	streamFrameSizeV1 = IndexSize + 8
+
+	// importChunk is the amount of data Import commits at once
+	importChunk = 1 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Exporter streams a range of a log in the export format, it is an
+// io.Reader and an io.WriterTo.
+type Exporter struct {
+	l    *Log
+	it   *Iterator
+	buf  []byte
+	off  int
+	head bool
+	done bool
+}
+
+// Export returns a stream of the records in [lo, hi]. Records are
+// exported decompressed and decrypted, Import applies the options of the
+// log it writes to.
+func (l *Log) Export(lo, hi uint64) *Exporter {
+	return &Exporter{l: l, it: l.Iterator(lo, hi)}
+}
+
+// Read implements io.Reader.
+func (e *Exporter) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		if e.off == len(e.buf) {
+			err = e.fill()
+			if err != nil {
+				return n, err
+			}
+		}
+		c := copy(p[n:], e.buf[e.off:])
+		e.off += c
+		n += c
+	}
+	return n, nil
+}
+
+// WriteTo implements io.WriterTo.
+func (e *Exporter) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		if e.off == len(e.buf) {
+			err = e.fill()
+			if err == io.EOF {
+				return n, nil
+			}
+			if err != nil {
+				return n, err
+			}
+		}
+		c, err := w.Write(e.buf[e.off:])
+		e.off += c
+		n += int64(c)
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// Close releases the iterator behind the stream.
+func (e *Exporter) Close() error {
+	e.done = true
+	return e.it.Close()
+}
+
+// fill puts the next part of the stream into buf.
+func (e *Exporter) fill() error {
+	if e.done {
+		if err := e.it.Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	e.buf = e.buf[:0]
+	e.off = 0
+	if !e.head {
+		e.head = true
+		e.buf = binary.BigEndian.AppendUint32(e.buf, streamMagic)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, streamVersion)
+		return nil
+	}
+	lease := e.l.Lease()
+	defer lease.Release()
+	if !e.it.Next() {
+		e.done = true
+		if err := e.it.Err(); err != nil {
+			return err
+		}
+		e.buf = appendFrame(e.buf, 0, RecordIns, nil, nil)
+		return nil
+	}
+	e.buf = appendFrame(e.buf, e.it.Index(), e.it.Op(), e.it.Meta(), e.it.Value())
+	return nil
+}
+
+func appendFrame(b []byte, idx uint64, op OpType, attrs map[string]string, data []byte) []byte {
+	flags := byte(op)
+	if len(attrs) > 0 {
+		flags |= flagAttrs
+		data = append(appendAttrs(nil, attrs), data...)
+	}
+	b = binary.BigEndian.AppendUint64(b, idx)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	b = append(b, flags)
+	b = binary.BigEndian.AppendUint32(b, frameChecksum(b[len(b)-13:], data))
+	return append(b, data...)
+}
+
+func frameChecksum(head, data []byte) uint32 {
+	return crc32.Update(crc32.Checksum(head, crcTable), crcTable, data)
+}
+
+// Import validates a stream produced by Export and appends its records
+// with their original indexes, following the rules of WriteAt. Records
+// are read and committed in chunks, n is the number of records appended
+// before an error. Appends of other goroutines may land between chunks,
+// the indexes of each chunk are checked against the log when it is
+// appended.
+func (l *Log) Import(r io.Reader) (n int, err error) {
+	return l.ImportContext(context.Background(), r)
+}
+
+// ImportContext is Import stopping with the error of ctx once ctx is
+// done, it is checked between records. ctx also bounds the sync of each
+// chunk, like in WriteContext.
+func (l *Log) ImportContext(ctx context.Context, r io.Reader) (n int, err error) {
+	if l.opts.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	err = ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	head := make([]byte, streamFrameSize)
+	_, err = io.ReadFull(r, head[:streamHeadSize])
+	if err != nil {
+		return 0, err
+	}
+	version := binary.BigEndian.Uint32(head[4:])
+	if binary.BigEndian.Uint32(head) != streamMagic || version < 1 || version > streamVersion {
+		return 0, ErrInvalidData
+	}
+	if version == 1 {
+		head = head[:streamFrameSizeV1]
+	}
+	sum := len(head) - 4
+
+	var (
+		recs []*Record
+		size int
+	)
+	commit := func() error {
+		if len(recs) == 0 {
+			return nil
+		}
+		l.wmu.Lock()
+		err := l.importRecords(recs, size)
+		l.wmu.Unlock()
+		if err != nil {
+			return err
+		}
+		n += len(recs)
+		recs, size = recs[:0], 0
+		return l.commit(ctx)
+	}
+	for {
+		err = ctx.Err()
+		if err != nil {
+			return n, err
+		}
+		_, err = io.ReadFull(r, head)
+		if err != nil {
+			return n, unexpected(err)
+		}
+		idx := binary.BigEndian.Uint64(head)
+		dsize := binary.BigEndian.Uint32(head[IndexSize:])
+		if idx == 0 {
+			if dsize != 0 || binary.BigEndian.Uint32(head[sum:]) != frameChecksum(head[:sum], nil) {
+				return n, ErrInvalidData
+			}
+			return n, commit()
+		}
+		if dsize >= RecordMaxSize {
+			return n, ErrOutOfRecordSize
+		}
+		data := make([]byte, dsize)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return n, unexpected(err)
+		}
+		if binary.BigEndian.Uint32(head[sum:]) != frameChecksum(head[:sum], data) {
+			return n, ErrInvalidData
+		}
+		rec := &Record{index: idx, op: RecordIns}
+		if version > 1 {
+			flags := head[IndexSize+4]
+			if flags&^streamFlags(version) != 0 {
+				return n, ErrInvalidData
+			}
+			rec.op = OpType(flags & opMask)
+			if flags&flagAttrs != 0 {
+				var k int
+				rec.attrs, k, err = readAttrs(data)
+				if err != nil {
+					return n, err
+				}
+				data = data[k:]
+			}
+		}
+		rec.data = data
+		cr, err := l.compress(rec, l.writer.Version())
+		if err != nil {
+			return n, err
+		}
+		recs = append(recs, cr)
+		size += frameSize(len(cr.data))
+		if size >= importChunk {
+			err = commit()
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+}
+
+// importRecords appends the prepared records recs of an import with
+// their own indexes, checked against the log as it is now, size is about
+// the size of their frames. The caller holds wmu.
+func (l *Log) importRecords(recs []*Record, size int) error {
+	frames := make([]byte, 0, size)
+	idxs := make([]uint64, len(recs))
+	last, prev := l.lastIndex.Load(), l.prevIndex()
+	empty := l.writer.Size() == HeaderSize
+	for i, r := range recs {
+		err := l.checkIndex(r.index, last, empty && i == 0)
+		if err != nil {
+			return err
+		}
+		r.prev = prev
+		b, err := l.frame(r)
+		if err != nil {
+			return err
+		}
+		frames = append(frames, b...)
+		idxs[i] = r.index
+		last, prev = r.index, r.index
+	}
+	return l.append(frames, idxs)
+}
+
+// streamFlags returns the frame flags known to the stream version.
+func streamFlags(version uint32) byte {
+	if version < 3 {
+		return opMask
+	}
+	return opMask | flagAttrs
+}
+
+// unexpected reports a stream that ends before its end frame.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
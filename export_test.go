@@ -0,0 +1,103 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalExportImport(t *testing.T) {
+	l, _ := tempLog(t, nil)
+	writeTables(t, l)
+
+	stream := &bytes.Buffer{}
+	_, err := l.Export(2, 4).WriteTo(stream)
+	assert.Equal(t, nil, err, "export")
+	read, err := io.ReadAll(l.Export(2, 4))
+	assert.Equal(t, nil, err, "export reader")
+	assert.Equal(t, stream.Bytes(), read, "reader and writer to agree")
+
+	dst, _ := tempLog(t, nil)
+	n, err := dst.Import(bytes.NewReader(stream.Bytes()))
+	assert.Equal(t, nil, err, "import")
+	assert.Equal(t, 3, n, "import")
+	assert.Equal(t, uint64(2), dst.FirstIndex(), "import")
+	assert.Equal(t, uint64(4), dst.LastIndex(), "import")
+	for i := uint64(2); i <= 4; i++ {
+		d, _ := dst.Read(i)
+		assert.Equal(t, tables[i].data, d, fmt.Sprintf("index: %d ", i))
+	}
+
+	_, err = dst.Import(bytes.NewReader(stream.Bytes()))
+	assert.Equal(t, ErrOutOfOrder, err, "import again")
+
+	corrupt := append([]byte{}, stream.Bytes()...)
+	corrupt[streamHeadSize+streamFrameSize] ^= 0xff
+	dst.TruncateBack(0)
+	_, err = dst.Import(bytes.NewReader(corrupt))
+	assert.Equal(t, ErrInvalidData, err, "corrupt")
+	_, err = dst.Import(bytes.NewReader(stream.Bytes()[:stream.Len()-1]))
+	assert.Equal(t, io.ErrUnexpectedEOF, err, "truncated")
+	assert.Equal(t, uint64(0), dst.FirstIndex(), "nothing imported")
+}
+
+func TestWalImportFlags(t *testing.T) {
+	data := append(appendAttrs(nil, map[string]string{"k": "v"}), 'x')
+	stream := func(version uint32, flags byte) io.Reader {
+		b := binary.BigEndian.AppendUint32(nil, streamMagic)
+		b = binary.BigEndian.AppendUint32(b, version)
+		start := len(b)
+		b = binary.BigEndian.AppendUint64(b, 1)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+		b = append(b, flags)
+		b = binary.BigEndian.AppendUint32(b, frameChecksum(b[start:], data))
+		b = append(b, data...)
+		return bytes.NewReader(appendFrame(b, 0, RecordIns, nil, nil))
+	}
+
+	l, _ := tempLog(t, nil)
+	_, err := l.Import(stream(2, flagAttrs))
+	assert.Equal(t, ErrInvalidData, err, "attributes in version 2")
+	_, err = l.Import(stream(3, 0x80|flagAttrs))
+	assert.Equal(t, ErrInvalidData, err, "unknown flag")
+	_, err = l.Import(stream(4, flagAttrs))
+	assert.Equal(t, ErrInvalidData, err, "unknown version")
+	n, err := l.Import(stream(3, flagAttrs|byte(RecordDel)))
+	assert.Equal(t, nil, err, "version 3")
+	assert.Equal(t, 1, n, "version 3")
+	e, _ := l.ReadEntry(1)
+	assert.Equal(t, map[string]string{"k": "v"}, e.Meta, "attributes")
+	assert.Equal(t, RecordDel, e.Op, "op")
+	assert.Equal(t, []byte("x"), e.Data, "data")
+}
+
+func TestWalImportConcurrentWrite(t *testing.T) {
+	l, _ := tempLog(t, nil)
+	writeTables(t, l)
+	stream := &bytes.Buffer{}
+	l.Export(2, 4).WriteTo(stream)
+
+	dst, _ := tempLog(t, nil)
+	dst.Write(tables[1].data)
+	pr, pw := io.Pipe()
+	type result struct {
+		n   int
+		err error
+	}
+	imported := make(chan result)
+	go func() {
+		n, err := dst.Import(pr)
+		imported <- result{n, err}
+	}()
+	pw.Write(stream.Next(streamHeadSize))
+	assert.Equal(t, nil, dst.Write(tables[2].data), "write while the import reads")
+	pw.Write(stream.Bytes())
+	res := <-imported
+	assert.Equal(t, ErrOutOfOrder, res.err, "checked against the log when appended")
+	assert.Equal(t, 0, res.n, "checked against the log when appended")
+	assert.Equal(t, uint64(2), dst.LastIndex(), "nothing imported")
+}
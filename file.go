@@ -16,6 +16,6 @@
 
 package wal
 
-func OpenFile(path string, opts *Option) IWal {
-	return nil
+func OpenFile(path string, opts *Option) (IFile, error) {
+	return nil, ErrNotSupported
 }
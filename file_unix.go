@@ -17,16 +17,26 @@
 package wal
 
 import (
+	"context"
 	"encoding/binary"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/sunvim/utils/cachem"
 )
 
+// UnixFile is a memory mapped file. Writers hold mu, readers of the
+// records take no lock: they read below end, which is published once the
+// bytes are in place, and register in readers so that anything moving or
+// discarding written data can wait for them to leave first.
 type UnixFile struct {
 	mu      sync.RWMutex
 	opts    *Option
@@ -36,37 +46,192 @@ type UnixFile struct {
 	mmpSize uint64
 	file    *os.File
 	ref     []byte
+	end     atomic.Int64
+	readers atomic.Int64
+	moving  atomic.Bool
+	closed  atomic.Bool
+	epoch   atomic.Uint64
+	head    uint64
+	version uint64
+
+	// gen is the header generation a read-only file was refreshed at
+	gen atomic.Uint32
+
+	// last is the end and index of the last whole frame, compact frames
+	// are read backwards from it
+	last atomic.Pointer[tail]
+}
+
+// tail locates the last whole frame of a file.
+type tail struct {
+	end   int64
+	index uint64
 }
 
 const (
 	defaultMemMapSize = 1 << 30
+
+	// quiesceSpins and quiesceMaxWait bound how quiesce waits for readers
+	quiesceSpins   = 64
+	quiesceMaxWait = time.Millisecond
+
+	// walkCheck is how many frames walk reads between checks of its context
+	walkCheck = 256
+
+	// journalSize and journalMagic describe the trailer of a Replace
+	// journal: stx(8B)+length(8B)+crc32c(4B)+magic(4B)
+	journalSize  = 24
+	journalMagic = 0x57414c4a // "WALJ"
 )
 
 func OpenFile(path string, opts *Option) (IFile, error) {
 	if opts == nil {
 		opts = defaultOption
 	}
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0664)
+	version := opts.FormatVersion
+	if version == 0 {
+		version = formatVersion
+	}
+	if version < formatV1 || version > formatLatest {
+		return nil, ErrVersion
+	}
+	flag := os.O_CREATE | os.O_RDWR
+	if opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flag, 0664)
 	if err != nil {
 		return nil, err
 	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if opts.ReadOnly && info.Size() < HeaderSize {
+		f.Close()
+		return nil, ErrFile
+	}
 	uf := &UnixFile{file: f, opts: opts, name: filepath.Base(path)}
 	uf.mmap()
-	uf.Write(defaultHeader.Marshal())
+	uf.version = version
+	if info.Size() < HeaderSize {
+		h := defaultHeader
+		h.version = version
+		uf.Write(h.Marshal())
+	} else {
+		uf.size = info.Size()
+		uf.offset = uf.size
+		uf.end.Store(uf.size)
+		if !opts.ReadOnly {
+			err = uf.replay()
+			if err != nil {
+				uf.Close()
+				return nil, err
+			}
+		}
+		if h, err := uf.Header(); err == nil {
+			uf.head = h.head
+			uf.version = h.version
+			uf.gen.Store(h.gen)
+		}
+		uf.track(uf.size, true)
+	}
 
 	return uf, nil
 }
 
+// Remove cuts [stx, end) out of the file, it does nothing on a read-only
+// file.
 func (f *UnixFile) Remove(stx, end int64) {
+	f.Replace(stx, end, nil)
+}
+
+// Replace puts p in place of [stx, end) and moves the data after it.
+//
+// The new contents of [stx, size) are first written as a journal past the
+// end of the file and synced, then copied in place. The journal is never
+// overwritten by the copy, so a Replace cut short by a crash is finished
+// by the next OpenFile, see replay.
+func (f *UnixFile) Replace(stx, end int64, p []byte) error {
+	if f.opts.ReadOnly {
+		return ErrReadOnly
+	}
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	buf := make([]byte, f.size-end, f.size-end)
-	copy(buf, f.ref[end:])
-	copy(f.ref[stx:], buf)
-	diff := end - stx
-	f.size = f.size - diff
-	f.offset = f.offset - diff
-	buf = nil // for gc
+	if f.ref == nil {
+		return ErrClosed
+	}
+	if stx < HeaderSize || stx > end || end > f.size {
+		return ErrInvalidData
+	}
+	n := int64(len(p)) + f.size - end
+	size := stx + n
+	jstart := f.size
+	if size > jstart {
+		jstart = size
+	}
+	if jstart+n+journalSize > int64(f.mmpSize) {
+		return ErrOutOfSize
+	}
+	f.quiesce()
+	defer f.resume()
+	f.grow(jstart + n + journalSize)
+	j := f.ref[jstart : jstart+n+journalSize]
+	copy(j, p)
+	copy(j[len(p):], f.ref[end:f.size])
+	binary.BigEndian.PutUint64(j[n:], uint64(stx))
+	binary.BigEndian.PutUint64(j[n+8:], uint64(n))
+	binary.BigEndian.PutUint32(j[n+16:], crc32.Checksum(j[:n], crcTable))
+	binary.BigEndian.PutUint32(j[n+20:], journalMagic)
+	err := f.file.Sync()
+	if err != nil {
+		f.file.Truncate(f.size)
+		return err
+	}
+	copy(f.ref[stx:], j[:n])
+	err = f.file.Sync()
+	if err != nil {
+		return err
+	}
+	f.offset += size - f.size
+	f.size = size
+	f.track(size, true)
+	f.end.Store(size)
+	return f.file.Truncate(size)
+}
+
+// replay finishes a Replace that was interrupted after its journal was
+// synced: the journal is copied in place again and the file cut after
+// it. A journal that is incomplete is left to recovery of the log, the
+// frames before it are untouched.
+func (f *UnixFile) replay() error {
+	if f.size < HeaderSize+journalSize {
+		return nil
+	}
+	t := f.ref[f.size-journalSize : f.size]
+	if binary.BigEndian.Uint32(t[20:]) != journalMagic {
+		return nil
+	}
+	stx := int64(binary.BigEndian.Uint64(t))
+	n := int64(binary.BigEndian.Uint64(t[8:]))
+	jstart := f.size - journalSize - n
+	if stx < HeaderSize || stx > f.size || n < 0 || n > f.size || jstart < stx+n {
+		return nil
+	}
+	j := f.ref[jstart : jstart+n]
+	if crc32.Checksum(j, crcTable) != binary.BigEndian.Uint32(t[16:]) {
+		return nil
+	}
+	copy(f.ref[stx:], j)
+	err := f.file.Sync()
+	if err != nil {
+		return err
+	}
+	f.size = stx + n
+	f.offset = f.size
+	f.end.Store(f.size)
+	return f.file.Truncate(f.size)
 }
 
 func (f *UnixFile) Check() error {
@@ -74,9 +239,12 @@ func (f *UnixFile) Check() error {
 	if err != nil {
 		return err
 	}
-	if h.magic != defaultHeader.magic || h.version != defaultHeader.version {
+	if h.magic != defaultHeader.magic {
 		return ErrFile
 	}
+	if h.version < formatV1 || h.version > formatLatest {
+		return ErrVersion
+	}
 	return nil
 }
 
@@ -84,6 +252,9 @@ func (f *UnixFile) Header() (*header, error) {
 	hs := cachem.Malloc(HeaderSize)
 	defer cachem.Free(hs)
 	_, err := f.ReadAt(hs, 0)
+	if err == ErrClosed {
+		return nil, err
+	}
 	if err != nil {
 		return nil, ErrFile
 	}
@@ -96,74 +267,133 @@ func (f *UnixFile) Header() (*header, error) {
 }
 
 func (f *UnixFile) First() (*Record, error) {
-	f.Seek(HeaderSize, io.SeekStart)
-	r := &Record{}
-	rs := cachem.Malloc(RecordSize)
-	defer cachem.Free(rs)
-	_, err := f.Read(rs)
-	if err != nil {
-		return nil, ErrInvalidData
-	}
-	rsize := binary.BigEndian.Uint32(rs)
-	records := cachem.Malloc(int(rsize))
-	defer cachem.Free(records)
-	_, err = f.Read(records)
-	if err != nil {
-		return nil, ErrInvalidData
-	}
-	err = r.Unmarshal(records)
-	if err != nil {
-		return nil, err
-	}
-	return r, nil
+	return f.ReadRecord(HeaderSize, 0)
 }
 
-func (f *UnixFile) Last() (*Record, error) {
-	f.Seek(RecordSize, io.SeekEnd)
-	r := &Record{}
-	rs := cachem.Malloc(RecordSize)
-	defer cachem.Free(rs)
-	_, err := f.Read(rs)
-	if err != nil {
-		return nil, ErrInvalidData
+// Last reads the record of the last whole frame, it starts from the end
+// of the file in every format version.
+func (f *UnixFile) Last() (r *Record, err error) {
+	if f.opts.ReadOnly {
+		defer f.verify(&err)
+		defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+		defer f.guard(&err)
 	}
-	rsize := binary.BigEndian.Uint32(rs) + RecordSize
-	records := cachem.Malloc(int(rsize))
-	defer cachem.Free(records)
-	f.Seek(int64(rsize), io.SeekEnd)
-	_, err = f.Read(records)
-	if err != nil {
-		return nil, ErrInvalidData
-	}
-	err = r.Unmarshal(records[RecordSize:])
-	if err != nil {
+	if err = f.enter(); err != nil {
 		return nil, err
 	}
-	return r, nil
+	defer f.leave()
+	a := f.last.Load()
+	return f.readBefore(a.end, a.index, a.end)
 }
 
+// Close unmaps and closes the file, later calls fail with ErrClosed.
 func (f *UnixFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ref == nil {
+		return ErrClosed
+	}
+	f.quiesce()
+	defer f.resume()
+	f.closed.Store(true)
+	f.end.Store(0)
 	f.munmap()
 	return f.file.Close()
 }
 
 func (f *UnixFile) Read(p []byte) (n int, err error) {
-	f.mu.RLock()
-	defer f.mu.RUnlock()
-	copy(p, f.ref[f.offset:])
-	n = len(p)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ref == nil {
+		return 0, ErrClosed
+	}
+	n, err = f.readAt(p, f.offset, f.size)
 	f.offset += int64(n)
 	return
 }
 
+// ReadAt reads the header under the lock and the records without it.
 func (f *UnixFile) ReadAt(p []byte, off int64) (n int, err error) {
-	f.mu.RLock()
-	defer f.mu.RUnlock()
-	copy(p, f.ref[off:])
-	return len(p), nil
+	if f.opts.ReadOnly {
+		defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+		defer f.guard(&err)
+	}
+	if off < HeaderSize {
+		f.mu.RLock()
+		defer f.mu.RUnlock()
+		if f.ref == nil {
+			return 0, ErrClosed
+		}
+		return f.readAt(p, off, f.size)
+	}
+	if err = f.enter(); err != nil {
+		return 0, err
+	}
+	defer f.leave()
+	return f.readAt(p, off, f.end.Load())
+}
+
+func (f *UnixFile) readAt(p []byte, off, end int64) (n int, err error) {
+	if off >= end {
+		return 0, io.EOF
+	}
+	n = copy(p, f.ref[off:end])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// enter registers a lock free reader, waiting while data is being moved.
+// It fails with ErrClosed once the file is closed.
+func (f *UnixFile) enter() error {
+	for {
+		f.readers.Add(1)
+		if !f.moving.Load() {
+			if f.closed.Load() {
+				f.readers.Add(-1)
+				return ErrClosed
+			}
+			return nil
+		}
+		f.readers.Add(-1)
+		// the mover holds mu until it is done
+		f.mu.RLock()
+		f.mu.RUnlock()
+	}
+}
+
+func (f *UnixFile) leave() {
+	f.readers.Add(-1)
+}
+
+// quiesce waits for the lock free readers to leave and keeps new ones
+// out, the caller holds mu. Readers only copy or parse a frame, so it
+// yields a few times before it backs off to sleeping.
+func (f *UnixFile) quiesce() {
+	f.moving.Store(true)
+	wait := time.Microsecond
+	for i := 0; f.readers.Load() > 0; i++ {
+		if i < quiesceSpins {
+			runtime.Gosched()
+			continue
+		}
+		time.Sleep(wait)
+		if wait < quiesceMaxWait {
+			wait *= 2
+		}
+	}
+}
+
+// resume lets readers back in under a new epoch.
+func (f *UnixFile) resume() {
+	f.epoch.Add(1)
+	f.moving.Store(false)
 }
 
 func (f *UnixFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	switch {
 	case whence == io.SeekStart:
 		f.offset = offset
@@ -176,39 +406,83 @@ func (f *UnixFile) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (f *UnixFile) Write(p []byte) (n int, err error) {
+	if f.opts.ReadOnly {
+		return 0, ErrReadOnly
+	}
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	if f.ref == nil {
+		return 0, ErrClosed
+	}
 	wn := len(p)
 	if f.offset+int64(wn) > int64(f.mmpSize) {
 		return 0, ErrOutOfSize
 	}
+	if f.overwrites(f.offset, wn) {
+		f.quiesce()
+		defer f.resume()
+	}
 	if f.offset+int64(wn) > f.size {
 		f.size = f.offset + int64(wn)
 		f.grow(f.size)
 	}
 	copy(f.ref[f.offset:], p)
 	f.offset += int64(wn)
+	f.publish()
 	return wn, nil
 }
 
-type FileInfo struct {
-	Offset uint64
-	Size   uint64
-	Header []byte
-	Name   string
+// overwrites reports whether writing n bytes at off changes records that
+// lock free readers may be reading.
+func (f *UnixFile) overwrites(off int64, n int) bool {
+	return off+int64(n) > HeaderSize && off < f.end.Load()
+}
+
+// publish makes everything written so far visible to lock free readers.
+func (f *UnixFile) publish() {
+	if f.size > f.end.Load() || f.last.Load() == nil {
+		f.track(f.size, false)
+		f.end.Store(f.size)
+	}
+}
+
+// track moves last over the whole frames below end, starting from the
+// first frame with reset. The caller holds mu and publishes end after.
+func (f *UnixFile) track(end int64, reset bool) {
+	var (
+		pos   int64 = HeaderSize
+		index uint64
+	)
+	if a := f.last.Load(); a != nil && !reset && a.end <= end {
+		pos, index = a.end, a.index
+	}
+	for pos < end {
+		n, idx, ok := frameHead(f.ref[pos:end], f.version, index)
+		if !ok || pos+n > end {
+			break
+		}
+		pos, index = pos+n, idx
+	}
+	f.last.Store(&tail{end: pos, index: index})
 }
 
 func (f *UnixFile) Info() *FileInfo {
 	fi := &FileInfo{}
-	h, _ := f.Header()
-	fi.Header = h.Marshal()
+	if h, err := f.Header(); err == nil {
+		fi.Header = h.Marshal()
+	}
 	fi.Name = f.name
+	f.mu.RLock()
 	fi.Offset = uint64(f.offset)
 	fi.Size = uint64(f.size)
+	f.mu.RUnlock()
 	return fi
 }
 
 func (f *UnixFile) WriteSize(size uint32) {
+	if f.opts.ReadOnly {
+		return
+	}
 	bs := cachem.Malloc(4)
 	defer cachem.Free(bs)
 	binary.BigEndian.PutUint32(bs, size)
@@ -216,83 +490,230 @@ func (f *UnixFile) WriteSize(size uint32) {
 }
 
 func (f *UnixFile) WriteAt(p []byte, off int64) (n int, err error) {
+	if f.opts.ReadOnly {
+		return 0, ErrReadOnly
+	}
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	if f.ref == nil {
+		return 0, ErrClosed
+	}
 	wn := len(p)
 	if off+int64(wn) > int64(f.mmpSize) {
 		return 0, ErrOutOfSize
 	}
 
+	if f.overwrites(off, wn) {
+		f.quiesce()
+		defer f.resume()
+	}
 	if off+int64(wn) > f.size {
 		f.size = off + int64(wn)
 		f.grow(f.size)
 	}
 	copy(f.ref[off:], p)
+	f.publish()
 
 	return wn, nil
 }
 
-func (f *UnixFile) Item(idx uint64) (*Item, error) {
-	f.mu.RLock()
-	defer f.mu.RUnlock()
-	rsizes := cachem.Malloc(RecordSize)
-	defer cachem.Free(rsizes)
-	indexs := cachem.Malloc(IndexSize)
-	defer cachem.Free(indexs)
-	var err error
-	item := &Item{}
-	var pos int64 = HeaderSize
+func (f *UnixFile) Item(idx uint64) (item *Item, err error) {
+	if f.opts.ReadOnly {
+		defer f.verify(&err)
+		defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+		defer f.guard(&err)
+	}
+	if err = f.enter(); err != nil {
+		return &Item{}, err
+	}
+	defer f.leave()
+	item, err = f.find(context.Background(), idx, false, f.end.Load())
+	if err != nil {
+		return &Item{}, err
+	}
+	return item, nil
+}
 
-	for {
-		f.ReadAt(rsizes, pos)
-		rsize := binary.BigEndian.Uint32(rsizes)
+func (f *UnixFile) Items() (res []*Item, err error) {
+	if f.opts.ReadOnly {
+		defer f.verify(&err)
+		defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+		defer f.guard(&err)
+	}
+	if err = f.enter(); err != nil {
+		return nil, err
+	}
+	defer f.leave()
+	res = make([]*Item, 0)
+	f.walk(context.Background(), f.end.Load(), func(off, n int64, index, prev uint64) bool {
+		res = append(res, &Item{offset: uint64(off), length: uint64(n), index: index, prev: prev})
+		return true
+	})
+	return res, nil
+}
 
-		if rsize == 0 {
-			err = ErrNotFound
-			break
+// CheckedItems returns the items of the intact frames at the start of the
+// file, it stops at the first frame that is torn or fails its checksum.
+func (f *UnixFile) CheckedItems() (res []*Item, err error) {
+	if f.opts.ReadOnly {
+		defer f.verify(&err)
+		defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+		defer f.guard(&err)
+	}
+	if err = f.enter(); err != nil {
+		return nil, err
+	}
+	defer f.leave()
+	res = make([]*Item, 0)
+	f.walk(context.Background(), f.end.Load(), func(off, n int64, index, prev uint64) bool {
+		if !checkFrame(f.ref[off:off+n], f.version, index) {
+			return false
 		}
+		res = append(res, &Item{offset: uint64(off), length: uint64(n), index: index, prev: prev})
+		return true
+	})
+	return res, nil
+}
 
-		f.ReadAt(indexs, pos+RecordSize)
-		index := binary.BigEndian.Uint64(indexs)
-		if index == idx {
-			item.offset = uint64(pos)
-			item.length = uint64(rsize) + RecordSize
-			item.index = index
-			break
+// walk calls fn with the offset, length, index and previous index of
+// each frame below end, until fn returns false. It checks ctx every
+// walkCheck frames and stops with its error. The caller has entered.
+func (f *UnixFile) walk(ctx context.Context, end int64, fn func(off, n int64, index, prev uint64) bool) error {
+	var (
+		pos  int64 = HeaderSize
+		prev uint64
+	)
+	for i := 0; pos < end; i++ {
+		if i%walkCheck == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 		}
-		pos += int64(rsize) + RecordSize
+		n, index, ok := frameHead(f.ref[pos:end], f.version, prev)
+		if !ok || pos+n > end || !fn(pos, n, index, prev) {
+			return nil
+		}
+		prev = index
+		pos += n
 	}
-	return item, err
+	return nil
 }
 
-func (f *UnixFile) Items() ([]*Item, error) {
-	f.mu.RLock()
-	defer f.mu.RUnlock()
-	rsizes := cachem.Malloc(RecordSize)
-	defer cachem.Free(rsizes)
-	indexs := cachem.Malloc(IndexSize)
-	defer cachem.Free(indexs)
+// Find returns the frame of the record idx, or with floor the frame of
+// the last record whose index is not greater than idx. It stops with the
+// error of ctx once ctx is done.
+func (f *UnixFile) Find(ctx context.Context, idx uint64, floor bool) (item *Item, err error) {
+	if f.opts.ReadOnly {
+		defer f.verify(&err)
+		defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+		defer f.guard(&err)
+	}
+	if err = f.enter(); err != nil {
+		return nil, err
+	}
+	defer f.leave()
+	return f.find(ctx, idx, floor, f.end.Load())
+}
 
-	var pos int64 = HeaderSize
-	res := make([]*Item, 0)
-	for {
-		if pos >= f.size {
-			break
-		}
-		f.ReadAt(rsizes, pos)
-		rsize := binary.BigEndian.Uint32(rsizes)
+// ReadIndex reads the record idx. The frame is found and read without
+// leaving in between, so data moved meanwhile cannot make it return
+// another record. With alias the data of the record points into the
+// mapping.
+func (f *UnixFile) ReadIndex(ctx context.Context, idx uint64, alias bool) (r *Record, err error) {
+	if f.opts.ReadOnly {
+		defer f.verify(&err)
+		defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+		defer f.guard(&err)
+	}
+	if err = f.enter(); err != nil {
+		return nil, err
+	}
+	defer f.leave()
+	end := f.end.Load()
+	item, err := f.find(ctx, idx, false, end)
+	if err != nil {
+		return nil, err
+	}
+	r, err = f.readRecord(int64(item.offset), item.prev, end, alias)
+	if err != nil {
+		return nil, err
+	}
+	if r.index != idx {
+		return nil, ErrInvalidData
+	}
+	return r, nil
+}
 
-		if rsize == 0 {
-			break
+func (f *UnixFile) find(ctx context.Context, idx uint64, floor bool, end int64) (*Item, error) {
+	if a := f.last.Load(); floor && a.end <= end {
+		return f.findBefore(ctx, idx, a)
+	}
+	var found *Item
+	err := f.walk(ctx, end, func(off, n int64, index, prev uint64) bool {
+		if index == idx || (floor && index < idx) {
+			found = &Item{offset: uint64(off), length: uint64(n), index: index, prev: prev}
 		}
+		return index != idx && (!floor || index < idx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
 
-		f.ReadAt(indexs, pos+RecordSize)
-		index := binary.BigEndian.Uint64(indexs)
+// findBefore walks back from the last frame a to the last record whose
+// index is not greater than idx, so reverse seeks near the end of a file
+// take a few steps. It checks ctx every walkCheck frames.
+func (f *UnixFile) findBefore(ctx context.Context, idx uint64, a *tail) (*Item, error) {
+	off, index := a.end, a.index
+	for i := 0; off > HeaderSize; i++ {
+		if i%walkCheck == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		n, ok := frameTail(f.ref[HeaderSize:off], f.version)
+		if !ok || off-n < HeaderSize {
+			return nil, ErrInvalidData
+		}
+		start := off - n
+		_, x, ok := frameHead(f.ref[start:off], f.version, 0)
+		if !ok {
+			return nil, ErrInvalidData
+		}
+		var prev uint64
+		if f.version >= formatV3 {
+			// x is the delta to the index of the frame before
+			if x > index {
+				return nil, ErrInvalidData
+			}
+			prev = index - x
+		} else {
+			index = x
+			if index <= idx {
+				prev = f.indexBefore(start)
+			}
+		}
+		if index <= idx {
+			return &Item{offset: uint64(start), length: uint64(n), index: index, prev: prev}, nil
+		}
+		off, index = start, prev
+	}
+	return nil, ErrNotFound
+}
 
-		res = append(res, &Item{offset: uint64(pos), length: uint64(rsize) + RecordSize, index: index})
-		pos += int64(rsize) + RecordSize
+// indexBefore returns the index of the version 1 or 2 frame that ends at
+// off, 0 if there is none.
+func (f *UnixFile) indexBefore(off int64) uint64 {
+	n, ok := frameTail(f.ref[HeaderSize:off], f.version)
+	if !ok || off-n < HeaderSize {
+		return 0
 	}
-	return res, nil
+	_, index, _ := frameHead(f.ref[off-n:off], f.version, 0)
+	return index
 }
 
 // Stat returns os.FileInfo describing the file.
@@ -300,21 +721,215 @@ func (f *UnixFile) Stat() (os.FileInfo, error) {
 	return f.file.Stat()
 }
 
-// Sync commits the current contents of the file.
+// Sync commits the current contents of the file, a read-only file has
+// nothing to commit.
 func (f *UnixFile) Sync() error {
+	if f.opts.ReadOnly {
+		return nil
+	}
+	if f.closed.Load() {
+		return ErrClosed
+	}
 	return f.file.Sync()
 }
 
 // Truncate changes the size of the file.
 func (f *UnixFile) Truncate(size int64) error {
+	if f.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ref == nil {
+		return ErrClosed
+	}
+	f.quiesce()
+	defer f.resume()
 	err := f.file.Truncate(size)
 	if err != nil {
 		return err
 	}
 	f.size = size
+	if size < f.last.Load().end {
+		f.track(size, true)
+	}
+	if size < f.end.Load() {
+		f.end.Store(size)
+	}
+	return nil
+}
+
+// ReadRecord reads the record whose frame starts at off, prev is the
+// index of the record before it, which compact frames need. With
+// Option.NoCopy the data of the record points into the mapping.
+func (f *UnixFile) ReadRecord(off int64, prev uint64) (r *Record, err error) {
+	if f.opts.ReadOnly {
+		defer f.verify(&err)
+		defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+		defer f.guard(&err)
+	}
+	if err = f.enter(); err != nil {
+		return nil, err
+	}
+	defer f.leave()
+	return f.readRecord(off, prev, f.end.Load(), f.opts.NoCopy)
+}
+
+// ReadRecordBefore reads the record whose frame ends at off, index is its
+// index, which compact frames need.
+func (f *UnixFile) ReadRecordBefore(off int64, index uint64) (r *Record, err error) {
+	if f.opts.ReadOnly {
+		defer f.verify(&err)
+		defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+		defer f.guard(&err)
+	}
+	if err = f.enter(); err != nil {
+		return nil, err
+	}
+	defer f.leave()
+	return f.readBefore(off, index, f.end.Load())
+}
+
+// readRecord reads the frame at off below end, with alias the data of the
+// record points into the mapping. The index of the record must follow
+// prev, a frame read from a stale offset rarely passes that and its
+// checksum.
+func (f *UnixFile) readRecord(off int64, prev uint64, end int64, alias bool) (*Record, error) {
+	if off < HeaderSize || off >= end {
+		return nil, ErrInvalidData
+	}
+	n, _, ok := frameHead(f.ref[off:end], f.version, prev)
+	if !ok || off+n > end {
+		return nil, ErrInvalidData
+	}
+	r := &Record{}
+	err := r.decodeFrame(f.ref[off:off+n], f.version, prev, f.opts.Encryption, alias)
+	if err != nil {
+		return nil, err
+	}
+	if r.index <= prev {
+		return nil, ErrInvalidData
+	}
+	return r, nil
+}
+
+// readBefore reads the frame that ends at off, its record must have the
+// index index unless that is 0.
+func (f *UnixFile) readBefore(off int64, index uint64, end int64) (*Record, error) {
+	if off <= HeaderSize || off > end {
+		return nil, ErrInvalidData
+	}
+	n, ok := frameTail(f.ref[HeaderSize:off], f.version)
+	if !ok || off-n < HeaderSize {
+		return nil, ErrInvalidData
+	}
+	var prev uint64
+	if f.version >= formatV3 {
+		_, delta, ok := frameHead(f.ref[off-n:off], f.version, 0)
+		if !ok || delta > index {
+			return nil, ErrInvalidData
+		}
+		prev = index - delta
+	}
+	r, err := f.readRecord(off-n, prev, off, f.opts.NoCopy)
+	if err != nil {
+		return nil, err
+	}
+	if index != 0 && r.index != index {
+		return nil, ErrInvalidData
+	}
+	return r, nil
+}
+
+// Size returns the end offset of the written data.
+func (f *UnixFile) Size() int64 {
+	return f.end.Load()
+}
+
+// TailIndex returns the index of the last whole frame, 0 if there is none.
+func (f *UnixFile) TailIndex() uint64 {
+	return f.last.Load().index
+}
+
+// Version returns the format version of the records in the file.
+func (f *UnixFile) Version() uint64 {
+	return f.version
+}
+
+// Epoch changes whenever written data is moved or discarded.
+func (f *UnixFile) Epoch() uint64 {
+	return f.epoch.Load()
+}
+
+// Refresh picks up the size and header written by another process. A
+// shrunk file, a moved head or a new generation starts a new epoch. The
+// header is read before the size, so the frames of its tail are always
+// covered.
+func (f *UnixFile) Refresh() (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer f.guard(&err)
+	h, err := f.Header()
+	if err != nil {
+		return err
+	}
+	info, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ref == nil {
+		return ErrClosed
+	}
+	size := info.Size()
+	if size > int64(f.mmpSize) {
+		size = int64(f.mmpSize)
+	}
+	moved := size < f.size || h.head != f.head || h.gen != f.gen.Load()
+	if moved {
+		f.quiesce()
+		defer f.resume()
+	}
+	f.size = size
+	f.offset = size
+	f.head = h.head
+	f.gen.Store(h.gen)
+	f.track(size, moved)
+	f.end.Store(size)
 	return nil
 }
 
+// verify turns the result of a read from a read-only file into
+// ErrTruncated when the writer has started a truncation since the last
+// Refresh, offsets and sizes taken from the file may no longer hold. It
+// reads the generation after the read, an odd one means the truncation
+// is still running.
+func (f *UnixFile) verify(err *error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.ref == nil {
+		return
+	}
+	gen := binary.BigEndian.Uint32(f.ref[8:12])
+	if gen&1 != 0 || gen != f.gen.Load() {
+		*err = ErrTruncated
+	}
+}
+
+// guard turns a fault on the mapping into ErrTruncated. Reading a page
+// past the end of the file faults, which happens in read-only mode when
+// another process shrinks the file before Refresh notices.
+func (f *UnixFile) guard(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if _, ok := r.(interface{ Addr() uintptr }); !ok {
+		panic(r)
+	}
+	*err = ErrTruncated
+}
+
 func (f *UnixFile) mmap() {
 	var (
 		b   []byte
@@ -325,7 +940,11 @@ func (f *UnixFile) mmap() {
 	} else {
 		f.mmpSize = defaultMemMapSize
 	}
-	b, err = syscall.Mmap(int(f.file.Fd()), 0, int(f.mmpSize), syscall.PROT_WRITE|syscall.PROT_READ, syscall.MAP_SHARED)
+	prot := syscall.PROT_WRITE | syscall.PROT_READ
+	if f.opts.ReadOnly {
+		prot = syscall.PROT_READ
+	}
+	b, err = syscall.Mmap(int(f.file.Fd()), 0, int(f.mmpSize), prot, syscall.MAP_SHARED)
 	if err != nil {
 		panic("mmap failed: " + err.Error())
 	}
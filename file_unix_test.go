@@ -3,6 +3,7 @@ package wal
 import (
 	"bytes"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -225,3 +226,70 @@ func BenchmarkUFWrite(b *testing.B) {
 		uf.Write(msg)
 	}
 }
+
+func TestReadOnlyFile(t *testing.T) {
+	os.RemoveAll(testfile)
+	_, err := OpenFile(testfile, &Option{ReadOnly: true})
+	assert.Equal(t, true, os.IsNotExist(err), "not created")
+
+	uf := openFile(testfile)
+	r := &Record{index: 1, data: []byte("hello")}
+	b, _ := r.Marshal()
+	uf.Write(b)
+	uf.Close()
+	before, _ := os.ReadFile(testfile)
+
+	ro, err := OpenFile(testfile, &Option{ReadOnly: true})
+	assert.Equal(t, nil, err, "open read-only")
+	_, err = ro.Write(b)
+	assert.Equal(t, ErrReadOnly, err, "write")
+	_, err = ro.WriteAt(b, HeaderSize)
+	assert.Equal(t, ErrReadOnly, err, "write at")
+	assert.Equal(t, ErrReadOnly, ro.Truncate(HeaderSize), "truncate")
+	ro.Remove(HeaderSize, int64(ro.Info().Size))
+	ro.WriteSize(1)
+	rr, err := ro.First()
+	assert.Equal(t, nil, err, "first")
+	assert.Equal(t, r.data, rr.data, "data")
+	ro.Close()
+
+	after, _ := os.ReadFile(testfile)
+	assert.Equal(t, before, after, "file unchanged")
+}
+
+func TestClosedFile(t *testing.T) {
+	f, err := OpenFile(filepath.Join(t.TempDir(), "wal"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Record{index: 1, data: []byte("hello")}
+	b, _ := r.Marshal()
+	f.Write(b)
+	assert.Equal(t, nil, f.Close(), "close")
+	assert.Equal(t, ErrClosed, f.Close(), "close twice")
+
+	p := make([]byte, HeaderSize)
+	_, err = f.ReadAt(p, 0)
+	assert.Equal(t, ErrClosed, err, "read header")
+	_, err = f.ReadAt(p, HeaderSize)
+	assert.Equal(t, ErrClosed, err, "read records")
+	_, err = f.Read(p)
+	assert.Equal(t, ErrClosed, err, "read")
+	_, err = f.Header()
+	assert.Equal(t, ErrClosed, err, "header")
+	_, err = f.First()
+	assert.Equal(t, ErrClosed, err, "first")
+	_, err = f.Last()
+	assert.Equal(t, ErrClosed, err, "last")
+	_, err = f.Item(1)
+	assert.Equal(t, ErrClosed, err, "item")
+	_, err = f.Items()
+	assert.Equal(t, ErrClosed, err, "items")
+	_, err = f.Write(b)
+	assert.Equal(t, ErrClosed, err, "write")
+	_, err = f.WriteAt(b, HeaderSize)
+	assert.Equal(t, ErrClosed, err, "write at")
+	assert.Equal(t, ErrClosed, f.Truncate(HeaderSize), "truncate")
+	assert.Equal(t, ErrClosed, f.Sync(), "sync")
+	assert.Equal(t, []byte(nil), f.Info().Header, "info")
+}
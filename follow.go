@@ -0,0 +1,167 @@
+// Copyright (c) 2022 mobus sunsc0220@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"context"
+	"math"
+	"sync"
+)
+
+// Follower reads the records of a log from an index on, and once it has
+// caught up blocks until new records are committed. With Option.NoCopy
+// Value is only valid while the caller holds a Lease, which in turn keeps
+// the data from being truncated or unmapped.
+type Follower struct {
+	l    *Log
+	ctx  context.Context
+	it   *Iterator
+	head bool
+	next uint64
+	idx  uint64
+	data []byte
+	err  error
+	stop chan struct{}
+	once sync.Once
+}
+
+// Follow returns a follower that starts at the record from, 0 starts at
+// the first record. It stops when ctx is cancelled, the follower or the
+// log is closed, or the log is truncated past its position.
+func (l *Log) Follow(ctx context.Context, from uint64) *Follower {
+	f := &Follower{
+		l:    l,
+		ctx:  ctx,
+		head: from == 0,
+		next: from,
+		stop: make(chan struct{}),
+	}
+	f.it = l.IteratorContext(ctx, from, math.MaxUint64)
+	return f
+}
+
+// Next blocks until the next record is committed and advances to it, it
+// returns false once the follower has stopped.
+func (f *Follower) Next() bool {
+	for f.err == nil {
+		changed, ok := f.read()
+		if ok || f.err != nil {
+			return ok
+		}
+		select {
+		case <-changed:
+		case <-f.stop:
+			return false
+		case <-f.ctx.Done():
+			f.err = f.ctx.Err()
+		}
+	}
+	return false
+}
+
+// read advances to the next committed record if there is one, otherwise
+// it returns a channel that is closed when the log changes. A lease keeps
+// the mapping in place underneath the read.
+func (f *Follower) read() (<-chan struct{}, bool) {
+	lease := f.l.Lease()
+	defer lease.Release()
+	first, last, closed, changed := f.l.watch.get()
+	if f.head && f.idx == 0 && f.next < first {
+		f.next = first
+		f.it.from = first
+	}
+	switch {
+	case closed:
+		f.err = ErrClosed
+	case f.next < first || f.idx > last:
+		f.err = ErrTruncated
+	case f.next <= last:
+		f.it.to = last
+		f.it.done = false
+		if f.it.Next() {
+			f.idx = f.it.Index()
+			f.data = f.it.Value()
+			f.next = f.idx + 1
+			return nil, true
+		}
+		f.err = f.it.Err()
+		// the rest of the committed range is a gap
+		f.next = last + 1
+	}
+	return changed, false
+}
+
+// Index returns the index of the current record.
+func (f *Follower) Index() uint64 {
+	return f.idx
+}
+
+// Value returns the data of the current record.
+func (f *Follower) Value() []byte {
+	return f.data
+}
+
+// Err returns the reason the follower stopped, nil after Close.
+func (f *Follower) Err() error {
+	return f.err
+}
+
+// Close stops the follower and wakes a blocked Next.
+func (f *Follower) Close() error {
+	f.once.Do(func() { close(f.stop) })
+	return nil
+}
+
+// watch publishes the index range of a log to goroutines waiting for it
+// to change.
+type watch struct {
+	mu     sync.Mutex
+	ch     chan struct{}
+	first  uint64
+	last   uint64
+	closed bool
+}
+
+// get returns the published range and a channel closed on the next change.
+func (w *watch) get() (first, last uint64, closed bool, changed <-chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ch == nil {
+		w.ch = make(chan struct{})
+	}
+	return w.first, w.last, w.closed, w.ch
+}
+
+func (w *watch) publish(first, last uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.first = first
+	w.last = last
+	w.wake()
+}
+
+func (w *watch) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	w.wake()
+}
+
+func (w *watch) wake() {
+	if w.ch != nil {
+		close(w.ch)
+		w.ch = nil
+	}
+}
@@ -0,0 +1,56 @@
+package wal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalFollow(t *testing.T) {
+	l, _ := tempLog(t, nil)
+	l.Write(tables[1].data)
+	l.Write(tables[2].data)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := uint64(3); i <= uint64(len(tables)); i++ {
+			l.Write(tables[i].data)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f := l.Follow(ctx, 0)
+	for i := uint64(1); i <= uint64(len(tables)); i++ {
+		assert.Equal(t, true, f.Next(), fmt.Sprintf("index: %d ", i))
+		assert.Equal(t, i, f.Index(), "follow index")
+		assert.Equal(t, tables[i].data, f.Value(), "follow value")
+	}
+	wg.Wait()
+
+	// Next gives up whether it is already waiting or not
+	go cancel()
+	assert.Equal(t, false, f.Next(), "cancelled")
+	assert.Equal(t, context.Canceled, f.Err(), "cancelled")
+
+	f = l.Follow(context.Background(), 4)
+	assert.Equal(t, true, f.Next(), "from 4")
+	assert.Equal(t, uint64(4), f.Index(), "from 4")
+	l.TruncateBack(3)
+	assert.Equal(t, false, f.Next(), "truncated")
+	assert.Equal(t, ErrTruncated, f.Err(), "truncated")
+
+	f = l.Follow(context.Background(), 4)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		l.Close()
+	}()
+	assert.Equal(t, false, f.Next(), "log closed")
+	assert.Equal(t, ErrClosed, f.Err(), "log closed")
+	wg.Wait()
+}
@@ -22,14 +22,32 @@ import (
 
 const HeaderSize = 32
 
+// header is stored as version(8B)+gen(4B)+magic(4B)+head(8B)+tail(8B).
+// gen is bumped to an odd value before a truncation moves or cuts frames
+// and to an even one after it, so a reader in another process can tell
+// that offsets it took earlier no longer hold. Version 1 files keep gen
+// 0, older releases read gen and magic as one word.
 type header struct {
 	version uint64
+	gen     uint32
 	magic   uint64
 	head    uint64
 	tail    uint64
 }
 
-var defaultHeader = header{version: 1, magic: 0xfaceface}
+// Format versions, see Record for the frames of each one. Files of any
+// version up to formatLatest can be read and written, each in its own
+// version. New files are in formatVersion unless Option.FormatVersion
+// says otherwise.
+const (
+	formatV1      = 1
+	formatV2      = 2
+	formatV3      = 3
+	formatVersion = formatV2
+	formatLatest  = formatV3
+)
+
+var defaultHeader = header{version: formatVersion, magic: 0xfaceface}
 
 func (h *header) Marshal() []byte {
 	headSlice := make([]byte, HeaderSize, HeaderSize)
@@ -37,7 +55,7 @@ func (h *header) Marshal() []byte {
 	defer cachem.Free(vs)
 	binary.BigEndian.PutUint64(vs, h.version)
 	copy(headSlice[:], vs)
-	binary.BigEndian.PutUint64(vs, h.magic)
+	binary.BigEndian.PutUint64(vs, uint64(h.gen)<<32|h.magic)
 	copy(headSlice[8:], vs)
 	binary.BigEndian.PutUint64(vs, h.head)
 	copy(headSlice[16:], vs)
@@ -51,7 +69,8 @@ func (h *header) Unmarshal(data []byte) error {
 		return ErrInvalidData
 	}
 	h.version = binary.BigEndian.Uint64(data[:8])
-	h.magic = binary.BigEndian.Uint64(data[8:16])
+	h.gen = binary.BigEndian.Uint32(data[8:12])
+	h.magic = uint64(binary.BigEndian.Uint32(data[12:16]))
 	h.head = binary.BigEndian.Uint64(data[16:24])
 	h.tail = binary.BigEndian.Uint64(data[24:])
 	return nil
@@ -15,15 +15,52 @@
 package wal
 
 import (
+	"context"
 	"io"
 	"os"
 )
 
+// IWal is the public interface of a write ahead log, it is implemented
+// by *Log.
 type IWal interface {
-	Close() error
-	Write(idx uint64, data []byte)
+	io.Closer
+
+	// FirstIndex returns the index of the first record, 0 if the log is empty
+	FirstIndex() uint64
+
+	// LastIndex returns the index of the last record
+	LastIndex() uint64
+
+	// Write appends data with the next index
+	Write(data []byte) error
+
+	// WriteAt appends data with the index idx
+	WriteAt(idx uint64, data []byte) error
+
+	// WriteBatch appends all records of b atomically
+	WriteBatch(b *Batch) (first, last uint64, err error)
+
+	// Read returns the data of the record idx
 	Read(idx uint64) (data []byte, err error)
+
+	// ReadBatch returns the data of the records idxes
+	ReadBatch(idxes ...uint64) (map[uint64][]byte, error)
+
+	// ReadRange returns copies of the data of the records in [lo, hi] up to
+	// maxBytes
+	ReadRange(lo, hi uint64, maxBytes int) (data [][]byte, next uint64, err error)
+
+	// Iterator returns an iterator over the records in [from, to]
+	Iterator(from, to uint64) *Iterator
+
+	// TruncateFront removes the records before idx
 	TruncateFront(idx uint64) error
+
+	// TruncateBack removes the records after idx
+	TruncateBack(idx uint64) error
+
+	// Sync flushes the log to disk
+	Sync() error
 }
 
 type IFile interface {
@@ -70,3 +107,56 @@ type IFile interface {
 	// Info
 	Info() *FileInfo
 }
+
+// recordFile is the part of a file the log needs beyond IFile. OpenFile
+// returns an IFile so that the methods the log uses internally can change
+// without breaking other implementations of IFile.
+type recordFile interface {
+	IFile
+
+	// Replace puts p in place of [stx, end) and moves the data after it
+	Replace(stx, end int64, p []byte) error
+
+	// CheckedItems is Items stopping at the first frame that is torn or
+	// fails its checksum
+	CheckedItems() ([]*Item, error)
+
+	// ReadRecord reads the record whose frame starts at off, prev is the
+	// index of the record before it
+	ReadRecord(off int64, prev uint64) (*Record, error)
+
+	// ReadRecordBefore reads the record whose frame ends at off, index is
+	// its index
+	ReadRecordBefore(off int64, index uint64) (*Record, error)
+
+	// Find returns the frame of the record idx, or with floor the frame of
+	// the last record whose index is not greater than idx
+	Find(ctx context.Context, idx uint64, floor bool) (*Item, error)
+
+	// ReadIndex finds and reads the record idx in one pass, with alias
+	// its data points into the file
+	ReadIndex(ctx context.Context, idx uint64, alias bool) (*Record, error)
+
+	// TailIndex returns the index of the last whole frame, 0 if there is
+	// none. It is below the header tail after TruncateBack into a gap
+	TailIndex() uint64
+
+	// Size returns the end offset of the written data
+	Size() int64
+
+	// Epoch changes whenever written data is moved or discarded
+	Epoch() uint64
+
+	// Refresh picks up the size and header written by another process
+	Refresh() error
+
+	// Version returns the format version of the records in the file
+	Version() uint64
+}
+
+type FileInfo struct {
+	Offset uint64
+	Size   uint64
+	Header []byte
+	Name   string
+}
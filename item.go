@@ -14,8 +14,11 @@
 
 package wal
 
+// Item locates the frame of a record, prev is the index of the record
+// before it.
 type Item struct {
 	offset uint64
 	index  uint64
 	length uint64
+	prev   uint64
 }
@@ -0,0 +1,257 @@
+// Copyright (c) 2022 mobus sunsc0220@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"context"
+)
+
+// Iterator walks the records whose index lies in [from, to].
+//
+// It keeps the file offset of its position and falls back to locating
+// records by index whenever the file's epoch shows data has been moved,
+// so appends and truncations running at the same time are safe.
+type Iterator struct {
+	l       *Log
+	ctx     context.Context
+	from    uint64
+	to      uint64
+	reverse bool
+	started bool
+	done    bool
+	closed  bool
+	epoch   uint64
+	pos     int64
+	at      uint64
+	rec     *Record
+	err     error
+	retries int
+}
+
+// Iterator returns an iterator over the records in [from, to], both inclusive.
+func (l *Log) Iterator(from, to uint64) *Iterator {
+	return l.IteratorContext(context.Background(), from, to)
+}
+
+// IteratorContext returns an iterator that stops with ctx's error once
+// ctx is done.
+func (l *Log) IteratorContext(ctx context.Context, from, to uint64) *Iterator {
+	return &Iterator{l: l, ctx: ctx, from: from, to: to}
+}
+
+// Reverse makes the iterator walk from to down to from. It has no effect
+// once Next has been called.
+func (it *Iterator) Reverse() *Iterator {
+	if !it.started {
+		it.reverse = true
+	}
+	return it
+}
+
+// Next advances to the next record, it returns false when the range is
+// exhausted or an error occurred.
+func (it *Iterator) Next() bool {
+	if it.closed || it.done || it.err != nil || it.from > it.to {
+		return false
+	}
+	if !it.started {
+		it.started = true
+		it.seek()
+	}
+	for {
+		if err := it.ctx.Err(); err != nil {
+			it.err = err
+			return false
+		}
+		if it.err == nil && it.l.writer.Epoch() != it.epoch {
+			it.seek()
+		}
+		var (
+			r   *Record
+			end bool
+		)
+		switch {
+		case it.err != nil:
+			// the seek failed, it may be retried below
+		case it.reverse:
+			r, end = it.prev()
+		default:
+			r, end = it.next()
+		}
+		if it.l.writer.Epoch() != it.epoch {
+			// data moved during the read, locate the position again
+			it.err = nil
+			continue
+		}
+		if it.l.retry(it.err, it.retries) {
+			// the writer of a read-only log truncated underneath the read
+			it.retries++
+			it.err = nil
+			it.seek()
+			continue
+		}
+		if end || it.err != nil {
+			it.done = true
+			it.rec = nil
+			return false
+		}
+		if r != nil {
+			it.rec = r
+			it.retries = 0
+			return true
+		}
+	}
+}
+
+// Index returns the index of the current record.
+func (it *Iterator) Index() uint64 {
+	if it.rec == nil {
+		return 0
+	}
+	return it.rec.index
+}
+
+// Value returns the data of the current record.
+func (it *Iterator) Value() []byte {
+	if it.rec == nil {
+		return nil
+	}
+	return it.rec.data
+}
+
+// Op returns the type of the current record.
+func (it *Iterator) Op() OpType {
+	if it.rec == nil {
+		return RecordIns
+	}
+	return it.rec.op
+}
+
+// Meta returns the metadata attributes of the current record, nil if it
+// has none.
+func (it *Iterator) Meta() map[string]string {
+	if it.rec == nil {
+		return nil
+	}
+	return it.rec.attrs
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterator, Next returns false afterwards.
+func (it *Iterator) Close() error {
+	it.closed = true
+	it.rec = nil
+	return nil
+}
+
+// seek positions the iterator at the record following the current one,
+// or at the start of the range before the first call to Next. When the
+// record sought is missing it moves to the nearest frame past it, the
+// start of the file if there is none before it. Other errors of the
+// search are left in err.
+func (it *Iterator) seek() {
+	it.epoch = it.l.writer.Epoch()
+	if it.reverse {
+		to := it.to
+		if it.rec != nil {
+			to = it.rec.index - 1
+		}
+		item, err := it.l.writer.Find(it.ctx, to, true)
+		switch {
+		case err == ErrNotFound:
+			it.pos, it.at = HeaderSize, 0
+		case err != nil:
+			it.err = err
+		default:
+			it.pos = int64(item.offset + item.length)
+			it.at = item.index
+		}
+		return
+	}
+	from := it.from
+	if it.rec != nil {
+		from = it.rec.index + 1
+	}
+	item, err := it.l.writer.Find(it.ctx, from, false)
+	if err == nil {
+		it.pos = int64(item.offset)
+		it.at = item.prev
+		return
+	}
+	if err == ErrNotFound && from > 1 {
+		// the frame after the last one below from
+		item, err = it.l.writer.Find(it.ctx, from-1, true)
+		if err == nil {
+			it.pos = int64(item.offset + item.length)
+			it.at = item.index
+			return
+		}
+	}
+	if err == ErrNotFound {
+		it.pos, it.at = HeaderSize, 0
+		return
+	}
+	it.err = err
+}
+
+// next reads the record at pos, at is the index of the one before it,
+// and moves past it. A nil record with end false means the record lies
+// before the range and should be skipped, a record past the range or not
+// committed yet is left in place.
+func (it *Iterator) next() (*Record, bool) {
+	if it.pos >= it.l.writer.Size() {
+		return nil, true
+	}
+	r, err := it.l.writer.ReadRecord(it.pos, it.at)
+	if err != nil {
+		it.err = err
+		return nil, true
+	}
+	if r.index > it.to || r.index > it.l.lastIndex.Load() {
+		return nil, true
+	}
+	it.pos += r.length
+	it.at = r.index
+	if r.index < it.from || (it.rec != nil && r.index <= it.rec.index) {
+		return nil, false
+	}
+	return r, false
+}
+
+// prev reads the record ending at pos, at is its index, and moves
+// before it.
+func (it *Iterator) prev() (*Record, bool) {
+	if it.pos <= HeaderSize {
+		return nil, true
+	}
+	r, err := it.l.writer.ReadRecordBefore(it.pos, it.at)
+	if err != nil {
+		it.err = err
+		return nil, true
+	}
+	if r.index < it.from {
+		return nil, true
+	}
+	it.pos -= r.length
+	it.at = r.prev
+	if r.index > it.to || r.index > it.l.lastIndex.Load() || (it.rec != nil && r.index >= it.rec.index) {
+		return nil, false
+	}
+	return r, false
+}
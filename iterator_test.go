@@ -0,0 +1,79 @@
+package wal
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalIterator(t *testing.T) {
+	l, _ := tempLog(t, nil)
+	writeTables(t, l)
+
+	var idxes []uint64
+	it := l.Iterator(2, 4)
+	for it.Next() {
+		assert.Equal(t, tables[it.Index()].data, it.Value(), fmt.Sprintf("index: %d ", it.Index()))
+		idxes = append(idxes, it.Index())
+	}
+	assert.Equal(t, nil, it.Err(), "forward")
+	assert.Equal(t, []uint64{2, 3, 4}, idxes, "forward")
+	it.Close()
+
+	idxes = idxes[:0]
+	it = l.Iterator(1, 100).Reverse()
+	for it.Next() {
+		assert.Equal(t, tables[it.Index()].data, it.Value(), fmt.Sprintf("index: %d ", it.Index()))
+		idxes = append(idxes, it.Index())
+	}
+	assert.Equal(t, nil, it.Err(), "reverse")
+	assert.Equal(t, []uint64{5, 4, 3, 2, 1}, idxes, "reverse")
+	it.Close()
+}
+
+func TestWalIteratorConcurrentWrite(t *testing.T) {
+	l, _ := tempLog(t, nil)
+	l.Write([]byte("0"))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i < 200; i++ {
+			l.Write([]byte(fmt.Sprint(i)))
+		}
+	}()
+
+	var last uint64
+	it := l.Iterator(1, 200)
+	for it.Next() {
+		assert.Equal(t, last+1, it.Index(), "in order")
+		assert.Equal(t, fmt.Sprint(it.Index()-1), string(it.Value()), "value")
+		last = it.Index()
+	}
+	assert.Equal(t, nil, it.Err(), "concurrent")
+	<-done
+}
+
+func TestWalIteratorSeek(t *testing.T) {
+	l, _ := tempLog(t, &Option{AllowGaps: true})
+	for i := uint64(2); i <= 6; i += 2 {
+		l.WriteAt(i, tables[1].data)
+	}
+	collect := func(it *Iterator) (idxs []uint64) {
+		for it.Next() {
+			idxs = append(idxs, it.Index())
+		}
+		assert.Equal(t, nil, it.Err(), "iterated")
+		return idxs
+	}
+	assert.Equal(t, []uint64{4, 6}, collect(l.Iterator(3, 6)), "from in a gap")
+	assert.Equal(t, []uint64{2, 4}, collect(l.Iterator(1, 4)), "from below the head")
+	assert.Equal(t, []uint64(nil), collect(l.Iterator(7, 9)), "from past the tail")
+	assert.Equal(t, []uint64{4, 2}, collect(l.Iterator(1, 5).Reverse()), "to in a gap")
+
+	l.Close()
+	it := l.Iterator(1, 6)
+	assert.Equal(t, false, it.Next(), "closed")
+	assert.Equal(t, ErrClosed, it.Err(), "search error kept")
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2022 mobus sunsc0220@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"context"
+	"sync"
+)
+
+// Lease pins the mapped data of a log. ReadNoCopy returns one with the
+// data it reads, and with Option.NoCopy iterators and followers return
+// slices that point into the mapping, which stay valid only while a lease
+// is held. Truncations wait until every lease is released, so a goroutine
+// must release its own leases before calling them; TruncateFrontContext
+// bounds the wait. Writes and Close go on while they wait. Close does not
+// wait either, it leaves the mapping to the last lease and fails the
+// truncations still waiting with ErrClosed.
+type Lease struct {
+	t    *leaseTable
+	once sync.Once
+}
+
+// Lease acquires a lease on the log's mapping.
+func (l *Log) Lease() *Lease {
+	l.leases.acquire()
+	return &Lease{t: &l.leases}
+}
+
+// Release gives the lease back, calling it more than once is a no-op.
+func (le *Lease) Release() {
+	le.once.Do(le.t.release)
+}
+
+// leaseTable counts the leases held on a mapping. Operations that move
+// data hold it locked, which waits for the count to drop to zero and
+// keeps new leases out until they are done. closer unmaps the data once
+// the count drops to zero after Close.
+type leaseTable struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	n      int
+	closer func() error
+}
+
+func (t *leaseTable) acquire() {
+	t.mu.Lock()
+	t.n++
+	t.mu.Unlock()
+}
+
+func (t *leaseTable) release() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.n--
+	if t.n > 0 {
+		return
+	}
+	if t.cond != nil {
+		t.cond.Broadcast()
+	}
+	if t.closer != nil {
+		t.closer()
+		t.closer = nil
+	}
+}
+
+// close calls fn at once when no lease is held and returns its error,
+// otherwise the release of the last lease calls it.
+func (t *leaseTable) close(fn func() error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.n > 0 {
+		t.closer = fn
+		return nil
+	}
+	return fn()
+}
+
+func (t *leaseTable) lock() {
+	t.mu.Lock()
+	if t.cond == nil {
+		t.cond = sync.NewCond(&t.mu)
+	}
+	for t.n > 0 {
+		t.cond.Wait()
+	}
+}
+
+// lockContext is lock giving up with the error of ctx once ctx is done.
+func (t *leaseTable) lockContext(ctx context.Context) error {
+	t.mu.Lock()
+	if t.cond == nil {
+		t.cond = sync.NewCond(&t.mu)
+	}
+	if t.n > 0 && ctx.Done() != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				t.mu.Lock()
+				t.cond.Broadcast()
+				t.mu.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+	for t.n > 0 {
+		err := ctx.Err()
+		if err != nil {
+			t.mu.Unlock()
+			return err
+		}
+		t.cond.Wait()
+	}
+	return nil
+}
+
+func (t *leaseTable) unlock() {
+	t.mu.Unlock()
+}
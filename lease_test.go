@@ -0,0 +1,80 @@
+package wal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalNoCopyLease(t *testing.T) {
+	l, _ := tempLog(t, nil)
+	writeTables(t, l)
+
+	d, lease, err := l.ReadNoCopy(2)
+	assert.Equal(t, nil, err, "no copy read")
+	assert.Equal(t, tables[2].data, d, "no copy read")
+	assert.Equal(t, len(d), cap(d), "capped view")
+	_, none, err := l.ReadNoCopy(9)
+	assert.Equal(t, ErrNotFound, err, "not found")
+	assert.Equal(t, (*Lease)(nil), none, "no lease without data")
+
+	c, err := l.Read(2)
+	assert.Equal(t, nil, err, "read")
+	assert.Equal(t, tables[2].data, c, "read")
+	c[0] = 'x'
+	assert.Equal(t, tables[2].data, d, "read copies")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go cancel()
+	assert.Equal(t, context.Canceled, l.TruncateFrontContext(ctx, 3), "lease held")
+	assert.Equal(t, uint64(1), l.FirstIndex(), "not truncated while a lease is held")
+	assert.Equal(t, tables[2].data, d, "view still valid")
+
+	truncated := make(chan error)
+	go func() {
+		truncated <- l.TruncateFront(3)
+	}()
+	lease.Release()
+	lease.Release()
+	assert.Equal(t, nil, <-truncated, "truncated after release")
+	assert.Equal(t, uint64(3), l.FirstIndex(), "truncated after release")
+
+	// Close leaves the mapping to the last lease
+	d, lease, err = l.ReadNoCopy(4)
+	assert.Equal(t, nil, err, "no copy read")
+	assert.Equal(t, nil, l.Close(), "close with a lease held")
+	assert.Equal(t, tables[4].data, d, "view valid after close")
+	_, err = l.Read(4)
+	assert.Equal(t, ErrClosed, err, "read after close")
+	lease.Release()
+	_, err = l.writer.Header()
+	assert.Equal(t, ErrClosed, err, "unmapped on release")
+}
+
+func TestWalNoCopyReadRange(t *testing.T) {
+	l, _ := tempLog(t, &Option{NoCopy: true})
+	writeTables(t, l)
+	data, _, err := l.ReadRange(1, 4, 0)
+	assert.Equal(t, nil, err, "read range")
+	assert.Equal(t, nil, l.TruncateFront(3), "no lease left held")
+	for i, d := range data {
+		assert.Equal(t, tables[uint64(i)+1].data, d, "copied")
+	}
+}
+
+func TestWalTruncateWaitingForLeases(t *testing.T) {
+	l, _ := tempLog(t, nil)
+	writeTables(t, l)
+	_, lease, _ := l.ReadNoCopy(2)
+	truncated := make(chan error)
+	go func() {
+		truncated <- l.TruncateBack(2)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, nil, l.Write([]byte("more")), "write while a truncation waits")
+	assert.Equal(t, nil, l.Close(), "close while a truncation waits")
+	lease.Release()
+	assert.Equal(t, ErrClosed, <-truncated, "truncation after close")
+}
@@ -14,12 +14,75 @@
 
 package wal
 
+import "time"
+
 type Option struct {
-	NoCopy   bool
+	// NoCopy makes iterators and followers return slices of the mapping,
+	// see Lease. Read and ReadRange always copy, ReadNoCopy returns a slice
+	// along with its lease
+	NoCopy bool
+
+	// NoSync leaves flushing to Sync. Records written since the last Sync
+	// may be lost in a crash, and version 1 files may keep torn records
 	NoSync   bool
 	MmapSize uint64
+
+	// AllowGaps lets WriteAt skip indexes after the last one
+	AllowGaps bool
+
+	// ReadOnly opens an existing log without write access and never
+	// modifies or creates the file, writes fail with ErrReadOnly. It can
+	// follow a log written by another process, see Log.Refresh
+	ReadOnly bool
+
+	// RefreshInterval is how often a read-only log polls for changes,
+	// 0 means defaultRefreshInterval and a negative value disables polling
+	RefreshInterval time.Duration
+
+	// MaxPendingEntries and MaxPendingBytes bound the records admitted for
+	// writing whose commit has not returned yet, bytes count whole frames.
+	// 0 means no limit
+	MaxPendingEntries int
+	MaxPendingBytes   int
+
+	// BusyTimeout is how long a write waits for room under the pending
+	// limits before failing with ErrBusy, 0 waits as long as it takes and
+	// a negative value fails at once
+	BusyTimeout time.Duration
+
+	// Compression compresses the data of records of at least CompressMin
+	// bytes, 0 meaning defaultCompressMin. Records that do not shrink are
+	// stored as they are. The Compressor must be registered, see
+	// RegisterCompressor. Files in format version 1 are not compressed
+	Compression Compressor
+	CompressMin int
+
+	// Encryption seals the data of new records with AES-GCM under the
+	// current key of the provider and opens records sealed with any of
+	// its keys. Attributes are not encrypted. Files in format version 1
+	// cannot hold encrypted records
+	Encryption KeyProvider
+
+	// FormatVersion is the format version of new files, 0 means the
+	// current one. Existing files keep their version, see Upgrade. Older
+	// versions stay readable by older releases of the package but cannot
+	// hold tombstones, attributes, compressed or encrypted records.
+	// Version 3 stores sizes and index deltas as varints, which saves
+	// 13 bytes per record on small records
+	FormatVersion uint64
+
+	// BloomFalsePositive enables bloom filters over the record indexes
+	// with this false positive rate, lookups of indexes the log does not
+	// hold then mostly fail without walking the file. 0 disables them.
+	// They take about 1.44*log2(1/p) bits per record and are rebuilt when
+	// the log is opened. Read-only logs do not use them
+	BloomFalsePositive float64
 }
 
+const defaultCompressMin = 128
+
+const defaultRefreshInterval = 100 * time.Millisecond
+
 var (
 	defaultOption = &Option{
 		MmapSize: 1 << 30,
@@ -0,0 +1,103 @@
+// Copyright (c) 2022 mobus sunsc0220@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Pending returns the records admitted for writing whose commit has not
+// returned yet, and their size in framed bytes. It includes records queued
+// by WriteAsync.
+func (l *Log) Pending() (entries, bytes int) {
+	l.pending.mu.Lock()
+	defer l.pending.mu.Unlock()
+	return l.pending.entries, l.pending.bytes
+}
+
+// pending admits writes while the records in flight stay within
+// Option.MaxPendingEntries and Option.MaxPendingBytes.
+type pending struct {
+	mu      sync.Mutex
+	entries int
+	bytes   int
+	ch      chan struct{}
+}
+
+// acquire admits entries records of bytes framed bytes, waiting for room
+// as Option.BusyTimeout says. Writes are always admitted when nothing
+// is pending, so a single write larger than the limit still goes through.
+func (p *pending) acquire(ctx context.Context, opts *Option, entries, bytes int) error {
+	var timeout <-chan time.Time
+	for {
+		p.mu.Lock()
+		if p.fits(opts, entries, bytes) {
+			p.entries += entries
+			p.bytes += bytes
+			p.mu.Unlock()
+			return nil
+		}
+		if p.ch == nil {
+			p.ch = make(chan struct{})
+		}
+		ch := p.ch
+		p.mu.Unlock()
+
+		if opts.BusyTimeout < 0 {
+			return ErrBusy
+		}
+		if opts.BusyTimeout > 0 && timeout == nil {
+			t := time.NewTimer(opts.BusyTimeout)
+			defer t.Stop()
+			timeout = t.C
+		}
+		select {
+		case <-ch:
+		case <-timeout:
+			return ErrBusy
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (p *pending) fits(opts *Option, entries, bytes int) bool {
+	if p.entries == 0 {
+		return true
+	}
+	if opts.MaxPendingEntries > 0 && p.entries+entries > opts.MaxPendingEntries {
+		return false
+	}
+	return opts.MaxPendingBytes <= 0 || p.bytes+bytes <= opts.MaxPendingBytes
+}
+
+// release returns the room taken by acquire and wakes the waiting writers.
+func (p *pending) release(entries, bytes int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.entries -= entries
+	p.bytes -= bytes
+	if p.ch != nil {
+		close(p.ch)
+		p.ch = nil
+	}
+}
+
+// frameSize is the size of the frame holding n bytes of data.
+func frameSize(n int) int {
+	return n + IndexSize + FlagSize + ChecksumSize + 2*RecordSize
+}
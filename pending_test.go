@@ -0,0 +1,107 @@
+package wal
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gateCompressor keeps writers inside Compress until gate is closed, so
+// their records stay pending.
+type gateCompressor struct {
+	entered chan struct{}
+	gate    chan struct{}
+}
+
+func (gateCompressor) ID() byte { return 201 }
+
+func (c gateCompressor) Compress(data []byte) ([]byte, error) {
+	select {
+	case c.entered <- struct{}{}:
+	default:
+	}
+	<-c.gate
+	return data, nil
+}
+
+func (gateCompressor) Decompress(data []byte) ([]byte, error) { return data, nil }
+
+func init() {
+	RegisterCompressor(gateCompressor{})
+}
+
+// holdLog opens a log with one write pending, which commits when the
+// returned function is called.
+func holdLog(t *testing.T, opts *Option) (*Log, func()) {
+	t.Helper()
+	c := gateCompressor{entered: make(chan struct{}, 1), gate: make(chan struct{})}
+	opts.NoSync = true
+	opts.Compression = c
+	if opts.CompressMin == 0 {
+		opts.CompressMin = 1
+	}
+	l, _ := tempLog(t, opts)
+
+	var (
+		wg   sync.WaitGroup
+		once sync.Once
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, nil, l.Write([]byte("held")), "held write")
+	}()
+	<-c.entered
+	release := func() {
+		once.Do(func() { close(c.gate) })
+		wg.Wait()
+	}
+	t.Cleanup(release)
+	return l, release
+}
+
+func TestWalBackpressure(t *testing.T) {
+	l, release := holdLog(t, &Option{MaxPendingEntries: 1, BusyTimeout: -1})
+	entries, bytes := l.Pending()
+	assert.Equal(t, 1, entries, "queue depth")
+	assert.Equal(t, frameSize(len("held")), bytes, "queue bytes")
+	assert.Equal(t, ErrBusy, l.Write([]byte("x")), "fail fast")
+	_, err := l.WriteAsync([]byte("x")).Wait()
+	assert.Equal(t, ErrBusy, err, "fail fast async")
+	release()
+	entries, bytes = l.Pending()
+	assert.Equal(t, 0, entries, "drained")
+	assert.Equal(t, 0, bytes, "drained bytes")
+	assert.Equal(t, nil, l.Write([]byte("x")), "admitted when drained")
+
+	const timeout = 10 * time.Millisecond
+	l, _ = holdLog(t, &Option{MaxPendingEntries: 1, BusyTimeout: timeout})
+	start := time.Now()
+	assert.Equal(t, ErrBusy, l.Write([]byte("x")), "deadline")
+	assert.Equal(t, true, time.Since(start) >= timeout, "waited")
+
+	l, release = holdLog(t, &Option{MaxPendingEntries: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	assert.Equal(t, context.DeadlineExceeded, l.WriteContext(ctx, []byte("x")), "context")
+	cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- l.Write([]byte("blocked"))
+	}()
+	release()
+	assert.Equal(t, nil, <-done, "admitted on release")
+	data, _ := l.Read(2)
+	assert.Equal(t, []byte("blocked"), data, "data")
+
+	l, _ = tempLog(t, &Option{NoSync: true, MaxPendingBytes: 1})
+	b := &Batch{}
+	b.Add([]byte("larger than the limit"))
+	_, _, err = l.WriteBatch(b)
+	assert.Equal(t, nil, err, "admitted when nothing is pending")
+	data, _ = l.Read(1)
+	assert.Equal(t, []byte("larger than the limit"), data, "data")
+}
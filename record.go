@@ -16,13 +16,16 @@ package wal
 
 import (
 	"encoding/binary"
-
-	"github.com/sunvim/utils/cachem"
+	"hash/crc32"
+	"sort"
 )
 
 const (
 	RecordSize    = 4
 	IndexSize     = 8
+	FlagSize      = 1
+	NonceSize     = 12
+	ChecksumSize  = 4
 	RecordMaxSize = 1 << 31
 )
 
@@ -31,36 +34,464 @@ const (
 	RecordDel
 )
 
+// OpType tells what a record does, a RecordDel record is a tombstone.
 type OpType int
 
+// Flags of a version 2 frame, the low bits hold the OpType.
+const (
+	opMask         = 0x0f
+	flagAttrs      = 0x10
+	flagCompressed = 0x20
+	flagEncrypted  = 0x40
+)
+
 // Record format:
-// rsize(4B)+index(8B)+data(NB)+rsize(4B)
+// version 1: rsize(4B)+index(8B)+data(NB)+rsize(4B)
+// version 2: rsize(4B)+index(8B)+flags(1B)+[comp(1B)]+[key(4B)+nonce(12B)]+
+// [attrs]+data(NB)+crc32c(4B)+rsize(4B)
+// version 3: size(uvarint)+delta(uvarint)+flags(1B)+[comp(1B)]+
+// [key(4B)+nonce(12B)]+[attrs]+data(NB)+crc32c(4B)+size(reversed uvarint)
+//
+// rsize counts the bytes after the leading rsize. The low bits of flags
+// hold the OpType, version 1 frames are all RecordIns. comp is only
+// present with flagCompressed, it is the ID of the Compressor of data.
+// key and nonce are only present with flagEncrypted, data is then sealed
+// with the key of that ID, see Option.Encryption. attrs is only present
+// with flagAttrs: its size as a uvarint followed by key and value pairs,
+// each a uvarint length and the bytes. crc32c covers the frame from the
+// leading rsize to the end of data, a frame torn by a crash fails it.
+//
+// Version 3 is the compact format. size counts the bytes from delta to
+// data and is repeated at the end with its bytes reversed, so the frame
+// can be found from either side. delta is the index minus the index of
+// the frame before, the first frame of a file stores its whole index.
+// crc32c covers the index of the record followed by the frame from size
+// to the end of data, so a frame read after the wrong one fails it.
 type Record struct {
-	index uint64
-	data  []byte
-	rsize uint32
+	index  uint64
+	data   []byte
+	rsize  uint32
+	op     OpType
+	attrs  map[string]string
+	comp   byte
+	prev   uint64
+	length int64
+
+	sealed bool
+	key    uint32
+	nonce  []byte
 }
 
+// Marshal frames the record in the current format version.
 func (r *Record) Marshal() ([]byte, error) {
-	ibs := cachem.Malloc(IndexSize)
-	binary.BigEndian.PutUint64(ibs, r.index)
-	r.rsize = uint32(len(r.data)) + IndexSize + RecordSize
-	if r.rsize >= RecordMaxSize {
+	return r.marshal(formatVersion)
+}
+
+// marshal frames the record in the format version, a version 3 frame
+// follows the record prev.
+func (r *Record) marshal(version uint64) ([]byte, error) {
+	if r.op < 0 || r.op > opMask {
+		return nil, ErrInvalidData
+	}
+	flags := byte(r.op)
+	ext := 0
+	if version >= formatV2 {
+		ext = FlagSize
+		if r.comp != 0 {
+			flags |= flagCompressed
+			ext++
+		}
+		if r.sealed {
+			flags |= flagEncrypted
+			ext += 4 + NonceSize
+		}
+		if len(r.attrs) > 0 {
+			flags |= flagAttrs
+			ext += attrsSize(r.attrs)
+		}
+	} else if r.op != RecordIns || len(r.attrs) > 0 || r.comp != 0 || r.sealed {
+		return nil, ErrOldFormat
+	}
+	if version >= formatV3 {
+		if r.index <= r.prev {
+			return nil, ErrOutOfOrder
+		}
+		delta := r.index - r.prev
+		size := uint64(uvarintSize(delta) + ext + len(r.data) + ChecksumSize)
+		if size >= RecordMaxSize {
+			return nil, ErrOutOfRecordSize
+		}
+		b := make([]byte, 0, 2*uvarintSize(size)+int(size))
+		b = binary.AppendUvarint(b, size)
+		b = binary.AppendUvarint(b, delta)
+		b = r.appendBody(b, flags, version)
+		b = binary.BigEndian.AppendUint32(b, compactSum(r.index, b))
+		b = appendReversedUvarint(b, size)
+		r.length = int64(len(b))
+		return b, nil
+	}
+	over := uint64(IndexSize + RecordSize + ext)
+	if version >= formatV2 {
+		over += ChecksumSize
+	}
+	if uint64(len(r.data))+over >= RecordMaxSize {
 		return nil, ErrOutOfRecordSize
 	}
-	rbs := cachem.Malloc(RecordSize)
-	binary.BigEndian.PutUint32(rbs, r.rsize)
-	defer func() { cachem.Free(ibs); cachem.Free(rbs) }()
-	return append(rbs, append(append(ibs, r.data...), rbs...)...), nil
+	r.rsize = uint32(uint64(len(r.data)) + over)
+	b := make([]byte, 0, r.rsize+RecordSize)
+	b = binary.BigEndian.AppendUint32(b, r.rsize)
+	b = binary.BigEndian.AppendUint64(b, r.index)
+	b = r.appendBody(b, flags, version)
+	if version >= formatV2 {
+		b = binary.BigEndian.AppendUint32(b, crc32.Checksum(b, crcTable))
+	}
+	b = binary.BigEndian.AppendUint32(b, r.rsize)
+	r.length = int64(len(b))
+	return b, nil
+}
+
+// appendBody appends what follows the index in a frame.
+func (r *Record) appendBody(b []byte, flags byte, version uint64) []byte {
+	if version >= formatV2 {
+		b = append(b, flags)
+		if flags&flagCompressed != 0 {
+			b = append(b, r.comp)
+		}
+		if flags&flagEncrypted != 0 {
+			b = binary.BigEndian.AppendUint32(b, r.key)
+			b = append(b, r.nonce...)
+		}
+		if flags&flagAttrs != 0 {
+			b = appendAttrs(b, r.attrs)
+		}
+	}
+	return append(b, r.data...)
 }
 
+// Unmarshal decodes a frame of the current format version without its
+// leading rsize.
 func (r *Record) Unmarshal(data []byte) error {
+	return r.decode(data, formatVersion, nil, false)
+}
+
+// decodeFrame reads the whole frame in the format version, prev is the
+// index of the frame before it. With alias the data of the record points
+// into frame, unless it had to be decompressed or decrypted. keys opens
+// encrypted data.
+func (r *Record) decodeFrame(frame []byte, version, prev uint64, keys KeyProvider, alias bool) error {
+	r.length = int64(len(frame))
+	r.prev = 0
+	if version < formatV3 {
+		if len(frame) < RecordSize {
+			return ErrInvalidData
+		}
+		return r.decode(frame[RecordSize:], version, keys, alias)
+	}
+	size, n := binary.Uvarint(frame)
+	if n <= 0 || uint64(len(frame)) != 2*uint64(n)+size {
+		return ErrInvalidData
+	}
+	if tail, m := lastUvarint(frame); m != n || tail != size {
+		return ErrInvalidData
+	}
+	body := frame[n : n+int(size)]
+	delta, m := binary.Uvarint(body)
+	if m <= 0 || delta == 0 || m+ChecksumSize > len(body) {
+		return ErrInvalidData
+	}
+	r.index = prev + delta
+	r.prev = prev
+	sum := n + int(size) - ChecksumSize
+	if compactSum(r.index, frame[:sum]) != binary.BigEndian.Uint32(frame[sum:]) {
+		return ErrChecksum
+	}
+	return r.decodeBody(body[m:len(body)-ChecksumSize], version, keys, alias)
+}
+
+// compactSum is the checksum of the version 3 frame b of the record idx,
+// b runs from size to the end of data.
+func compactSum(idx uint64, b []byte) uint32 {
+	var x [IndexSize]byte
+	binary.BigEndian.PutUint64(x[:], idx)
+	return crc32.Update(crc32.Checksum(x[:], crcTable), crcTable, b)
+}
+
+// decode reads a version 1 or 2 frame without its leading rsize.
+func (r *Record) decode(data []byte, version uint64, keys KeyProvider, alias bool) error {
 	if len(data) < IndexSize+RecordSize {
 		return ErrInvalidData
 	}
 	r.index = binary.BigEndian.Uint64(data[:IndexSize])
 	r.rsize = binary.BigEndian.Uint32(data[len(data)-RecordSize:])
-	r.data = make([]byte, r.rsize-IndexSize-RecordSize)
-	copy(r.data, data[IndexSize:])
+	end := int(r.rsize) - RecordSize
+	if end < IndexSize || end > len(data)-RecordSize {
+		return ErrInvalidData
+	}
+	if version >= formatV2 {
+		end -= ChecksumSize
+		if end < IndexSize {
+			return ErrInvalidData
+		}
+		sum := crc32.Checksum(data[end+ChecksumSize:end+ChecksumSize+RecordSize], crcTable)
+		sum = crc32.Update(sum, crcTable, data[:end])
+		if sum != binary.BigEndian.Uint32(data[end:]) {
+			return ErrChecksum
+		}
+	}
+	return r.decodeBody(data[IndexSize:end], version, keys, alias)
+}
+
+// checkFrame reports whether the whole frame of the record idx in the
+// format version is intact. Version 1 frames carry no checksum and only
+// their sizes are compared.
+func checkFrame(frame []byte, version, idx uint64) bool {
+	if version >= formatV3 {
+		size, k := binary.Uvarint(frame)
+		if k <= 0 || uint64(len(frame)) != 2*uint64(k)+size || size < ChecksumSize {
+			return false
+		}
+		if tail, m := lastUvarint(frame); m != k || tail != size {
+			return false
+		}
+		sum := k + int(size) - ChecksumSize
+		return compactSum(idx, frame[:sum]) == binary.BigEndian.Uint32(frame[sum:])
+	}
+	n := len(frame)
+	if n < 2*RecordSize+IndexSize {
+		return false
+	}
+	rsize := binary.BigEndian.Uint32(frame)
+	if int(rsize) != n-RecordSize || binary.BigEndian.Uint32(frame[n-RecordSize:]) != rsize {
+		return false
+	}
+	if version < formatV2 {
+		return true
+	}
+	end := n - RecordSize - ChecksumSize
+	if end < RecordSize+IndexSize {
+		return false
+	}
+	return crc32.Checksum(frame[:end], crcTable) == binary.BigEndian.Uint32(frame[end:])
+}
+
+// decodeBody reads what follows the index in a frame, r.index is set.
+func (r *Record) decodeBody(b []byte, version uint64, keys KeyProvider, alias bool) error {
+	r.op = RecordIns
+	r.attrs = nil
+	r.comp = 0
+	r.sealed = false
+	if version >= formatV2 {
+		if len(b) < FlagSize {
+			return ErrInvalidData
+		}
+		flags := b[0]
+		b = b[FlagSize:]
+		r.op = OpType(flags & opMask)
+		var comp byte
+		if flags&flagCompressed != 0 {
+			if len(b) == 0 {
+				return ErrInvalidData
+			}
+			comp = b[0]
+			b = b[1:]
+		}
+		if flags&flagEncrypted != 0 {
+			if len(b) < 4+NonceSize {
+				return ErrInvalidData
+			}
+			r.sealed = true
+			r.key = binary.BigEndian.Uint32(b)
+			r.nonce = append(r.nonce[:0], b[4:4+NonceSize]...)
+			b = b[4+NonceSize:]
+		}
+		if flags&flagAttrs != 0 {
+			attrs, n, err := readAttrs(b)
+			if err != nil {
+				return err
+			}
+			r.attrs = attrs
+			b = b[n:]
+		}
+		if comp != 0 || r.sealed {
+			d := b
+			if r.sealed {
+				var err error
+				d, err = r.open(d, keys)
+				if err != nil {
+					return err
+				}
+				r.sealed = false
+			}
+			if comp != 0 {
+				c := lookupCompressor(comp)
+				if c == nil {
+					return ErrCompressor
+				}
+				var err error
+				d, err = c.Decompress(d)
+				if err != nil {
+					return ErrInvalidData
+				}
+			}
+			r.data = d
+			return nil
+		}
+	}
+	if alias {
+		r.data = b[:len(b):len(b)]
+		return nil
+	}
+	r.data = make([]byte, len(b))
+	copy(r.data, b)
 	return nil
 }
+
+// frameHeadMax is the most bytes frameHead needs.
+const frameHeadMax = 2 * binary.MaxVarintLen64
+
+// frameHead parses the start of the frame in b, prev is the index of the
+// frame before it. It returns the length and the index of the frame, ok
+// is false when b does not start with a frame.
+func frameHead(b []byte, version, prev uint64) (n int64, index uint64, ok bool) {
+	if version < formatV3 {
+		if len(b) < RecordSize+IndexSize {
+			return 0, 0, false
+		}
+		rsize := binary.BigEndian.Uint32(b)
+		if rsize < IndexSize+RecordSize {
+			return 0, 0, false
+		}
+		return int64(rsize) + RecordSize, binary.BigEndian.Uint64(b[RecordSize:]), true
+	}
+	size, k := binary.Uvarint(b)
+	if k <= 0 || size == 0 || size >= RecordMaxSize {
+		return 0, 0, false
+	}
+	body := b[k:]
+	if uint64(len(body)) > size {
+		body = body[:size]
+	}
+	delta, m := binary.Uvarint(body)
+	if m <= 0 || delta == 0 {
+		return 0, 0, false
+	}
+	return 2*int64(k) + int64(size), prev + delta, true
+}
+
+// frameTail returns the length of the frame that ends b, using its
+// trailing size.
+func frameTail(b []byte, version uint64) (n int64, ok bool) {
+	if version < formatV3 {
+		if len(b) < RecordSize {
+			return 0, false
+		}
+		rsize := binary.BigEndian.Uint32(b[len(b)-RecordSize:])
+		if rsize < IndexSize+RecordSize {
+			return 0, false
+		}
+		return int64(rsize) + RecordSize, true
+	}
+	size, k := lastUvarint(b)
+	if k <= 0 || size == 0 || size >= RecordMaxSize {
+		return 0, false
+	}
+	return 2*int64(k) + int64(size), true
+}
+
+// appendReversedUvarint appends x as a uvarint with its bytes reversed.
+func appendReversedUvarint(b []byte, x uint64) []byte {
+	start := len(b)
+	b = binary.AppendUvarint(b, x)
+	for i, j := start, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
+
+// lastUvarint decodes the reversed uvarint that ends b and returns it with
+// its length, which is 0 when there is none.
+func lastUvarint(b []byte) (uint64, int) {
+	var (
+		x uint64
+		s uint
+	)
+	for i := 0; i < len(b) && i < binary.MaxVarintLen64; i++ {
+		c := b[len(b)-1-i]
+		if c < 0x80 {
+			return x | uint64(c)<<s, i + 1
+		}
+		x |= uint64(c&0x7f) << s
+		s += 7
+	}
+	return 0, 0
+}
+
+// attrsSize returns the encoded size of attrs.
+func attrsSize(attrs map[string]string) int {
+	n := 0
+	for k, v := range attrs {
+		n += uvarintSize(uint64(len(k))) + len(k) + uvarintSize(uint64(len(v))) + len(v)
+	}
+	return uvarintSize(uint64(n)) + n
+}
+
+// appendAttrs encodes attrs sorted by key, so equal attributes always
+// produce equal frames.
+func appendAttrs(b []byte, attrs map[string]string) []byte {
+	keys := make([]string, 0, len(attrs))
+	n := 0
+	for k, v := range attrs {
+		keys = append(keys, k)
+		n += uvarintSize(uint64(len(k))) + len(k) + uvarintSize(uint64(len(v))) + len(v)
+	}
+	sort.Strings(keys)
+	b = binary.AppendUvarint(b, uint64(n))
+	for _, k := range keys {
+		b = binary.AppendUvarint(b, uint64(len(k)))
+		b = append(b, k...)
+		b = binary.AppendUvarint(b, uint64(len(attrs[k])))
+		b = append(b, attrs[k]...)
+	}
+	return b
+}
+
+// readAttrs decodes the attributes at the start of data and returns the
+// number of bytes they take.
+func readAttrs(data []byte) (map[string]string, int, error) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || size > uint64(len(data)-n) {
+		return nil, 0, ErrInvalidData
+	}
+	block := data[n : n+int(size)]
+	attrs := make(map[string]string)
+	for len(block) > 0 {
+		k, rest, ok := readString(block)
+		if !ok {
+			return nil, 0, ErrInvalidData
+		}
+		v, rest, ok := readString(rest)
+		if !ok {
+			return nil, 0, ErrInvalidData
+		}
+		attrs[k] = v
+		block = rest
+	}
+	return attrs, n + int(size), nil
+}
+
+func readString(b []byte) (string, []byte, bool) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || l > uint64(len(b)-n) {
+		return "", nil, false
+	}
+	return string(b[n : n+int(l)]), b[n+int(l):], true
+}
+
+func uvarintSize(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
+}
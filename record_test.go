@@ -0,0 +1,168 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalCompact(t *testing.T) {
+	size := func(version uint64) int64 {
+		l, _ := tempLog(t, &Option{FormatVersion: version})
+		writeTables(t, l)
+		return l.writer.Size()
+	}
+	assert.Equal(t, true, size(formatV3) < size(formatV2), "smaller frames")
+
+	ring := &KeyRing{Current: 1, Keys: map[uint32][]byte{1: bytes.Repeat([]byte("k"), 32)}}
+	opts := &Option{FormatVersion: formatV3, AllowGaps: true, Compression: Deflate, CompressMin: 8, Encryption: ring}
+	l, path := tempLog(t, opts)
+	writeTables(t, l)
+	b := &Batch{}
+	b.Add(bytes.Repeat([]byte("z"), 300))
+	b.AddWithMeta([]byte("meta"), map[string]string{"k": "v"})
+	b.AddTombstone(2)
+	first, last, err := l.WriteBatch(b)
+	assert.Equal(t, nil, err, "batch")
+	assert.Equal(t, uint64(6), first, "batch first")
+	assert.Equal(t, uint64(8), last, "batch last")
+	assert.Equal(t, nil, l.WriteAt(1000, []byte("far")), "gap")
+	assert.Equal(t, ErrOutOfOrder, l.WriteAt(999, []byte("back")), "order")
+
+	for i := uint64(1); i <= uint64(len(tables)); i++ {
+		data, err := l.Read(i)
+		assert.Equal(t, nil, err, "read")
+		assert.Equal(t, tables[i].data, data, "data")
+	}
+	data, _ := l.Read(6)
+	assert.Equal(t, bytes.Repeat([]byte("z"), 300), data, "compressed")
+	e, _ := l.ReadEntry(7)
+	assert.Equal(t, map[string]string{"k": "v"}, e.Meta, "meta")
+	e, _ = l.ReadEntry(8)
+	assert.Equal(t, RecordDel, e.Op, "tombstone")
+	data, _ = l.Read(1000)
+	assert.Equal(t, []byte("far"), data, "after the gap")
+
+	want := []uint64{1, 2, 3, 4, 5, 6, 7, 8, 1000}
+	var got []uint64
+	it := l.Iterator(0, 2000)
+	for it.Next() {
+		got = append(got, it.Index())
+	}
+	assert.Equal(t, want, got, "forward")
+	got = got[:0]
+	it = l.Iterator(3, 999).Reverse()
+	for it.Next() {
+		got = append(got, it.Index())
+	}
+	assert.Equal(t, []uint64{8, 7, 6, 5, 4, 3}, got, "reverse")
+	assert.Equal(t, nil, it.Err(), "reverse error")
+
+	assert.Equal(t, nil, l.TruncateFront(3), "truncate front")
+	assert.Equal(t, nil, l.TruncateBack(7), "truncate back")
+	l.Write([]byte("tail"))
+	l.Close()
+
+	l = openLog(t, path, opts)
+	assert.Equal(t, uint64(3), l.FirstIndex(), "first index")
+	assert.Equal(t, uint64(8), l.LastIndex(), "last index")
+	r, _ := l.writer.First()
+	assert.Equal(t, uint64(3), r.index, "first frame")
+	r, _ = l.writer.Last()
+	assert.Equal(t, []byte("tail"), r.data, "last frame")
+	for i := uint64(3); i <= uint64(len(tables)); i++ {
+		data, _ := l.Read(i)
+		assert.Equal(t, tables[i].data, data, "data after truncation")
+	}
+
+	var buf bytes.Buffer
+	_, err = l.Export(3, 8).WriteTo(&buf)
+	assert.Equal(t, nil, err, "export")
+	l.Close()
+	l, path = tempLog(t, opts)
+	_, err = l.Import(&buf)
+	assert.Equal(t, nil, err, "import")
+	data, _ = l.Read(8)
+	assert.Equal(t, []byte("tail"), data, "imported")
+
+	ro := openLog(t, path, &Option{ReadOnly: true, RefreshInterval: -1, Encryption: ring})
+	l.Write([]byte("more"))
+	assert.Equal(t, nil, ro.Refresh(), "refresh")
+	data, _ = ro.Read(9)
+	assert.Equal(t, []byte("more"), data, "followed")
+	ro.Close()
+	l.Close()
+	assert.Equal(t, nil, Upgrade(path, &Option{FormatVersion: formatV2, Encryption: ring}), "newer version kept")
+	assert.Equal(t, uint64(formatV3), fileVersion(t, path), "still compact")
+}
+
+func TestWalCompactTail(t *testing.T) {
+	// floor is the last of items whose index is not greater than idx
+	floor := func(items []*Item, idx uint64) *Item {
+		var found *Item
+		for _, item := range items {
+			if item.index <= idx {
+				found = item
+			}
+		}
+		return found
+	}
+	check := func(t *testing.T, l *Log, last uint64, msg string) {
+		t.Helper()
+		r, err := l.writer.Last()
+		assert.Equal(t, nil, err, msg)
+		assert.Equal(t, last, r.index, msg)
+		items, _ := l.writer.Items()
+		for idx := uint64(0); idx <= last+3; idx++ {
+			item, err := l.writer.Find(context.Background(), idx, true)
+			want := floor(items, idx)
+			if want == nil {
+				assert.Equal(t, ErrNotFound, err, msg)
+				continue
+			}
+			assert.Equal(t, want, item, fmt.Sprintf("%s: floor of %d", msg, idx))
+		}
+	}
+	for _, version := range []uint64{formatV1, formatV2, formatV3} {
+		t.Run(fmt.Sprint(version), func(t *testing.T) {
+			l, path := tempLog(t, &Option{FormatVersion: version, AllowGaps: true, NoSync: true})
+			for i := uint64(1); i <= 50; i++ {
+				l.WriteAt(i*3, []byte(fmt.Sprint(i)))
+			}
+			check(t, l, 150, "written")
+			l.TruncateBack(100)
+			check(t, l, 99, "truncated back")
+			l.TruncateFront(30)
+			check(t, l, 99, "truncated front")
+			// the tail stays at 100, in the gap after the last frame
+			l.Write([]byte("more"))
+			check(t, l, 101, "appended")
+			ro := openLog(t, path, &Option{ReadOnly: true, RefreshInterval: -1})
+			check(t, ro, 101, "read-only")
+			l.Write([]byte("more"))
+			ro.Refresh()
+			check(t, ro, 102, "refreshed")
+			l.Close()
+			check(t, openLog(t, path, nil), 102, "reopened")
+		})
+	}
+
+	// the index of a compact frame is covered by its checksum
+	l, path := tempLog(t, &Option{FormatVersion: formatV3})
+	writeTables(t, l)
+	items, _ := l.writer.Items()
+	_, err := l.writer.ReadRecord(int64(items[3].offset), items[3].prev+1)
+	assert.Equal(t, ErrChecksum, err, "read after the wrong frame")
+	l.Close()
+	raw, _ := os.ReadFile(path)
+	raw[items[3].offset+1]++
+	if err := os.WriteFile(path, raw, 0664); err != nil {
+		t.Fatal(err)
+	}
+	l = openLog(t, path, &Option{FormatVersion: formatV3})
+	assert.Equal(t, uint64(3), l.LastIndex(), "cut at the damaged frame")
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2022 mobus sunsc0220@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"sync"
+	"time"
+)
+
+// Refresh picks up the records another process has committed to the log
+// and the truncations it has made since the last call. It only applies to
+// a log opened with Option.ReadOnly, which also calls it every
+// Option.RefreshInterval. Readers, followers and subscribers see the new
+// range as if it had been written by this process.
+//
+// The header tail is the commit point, frames past it are ignored until
+// the writer commits them. The writer bumps the header generation around
+// every truncation. A read that sees it change refreshes the log and is
+// retried, a record truncated meanwhile is then not found. Reads check
+// the checksum and index of every frame, a fault on a page cut from the
+// file is only the last resort and fails with ErrTruncated.
+func (l *Log) Refresh() error {
+	if !l.opts.ReadOnly {
+		return nil
+	}
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	if l.closed.Load() {
+		return ErrClosed
+	}
+	h, err := l.writer.Header()
+	if err != nil {
+		return err
+	}
+	err = l.writer.Refresh()
+	if err != nil {
+		return err
+	}
+	first, last := l.fistIndex.Load(), l.lastIndex.Load()
+	if h.head == first && h.tail == last {
+		return nil
+	}
+	l.fistIndex.Store(h.head)
+	l.lastIndex.Store(h.tail)
+	if h.tail < last {
+		l.subs.rewind(h.tail)
+	}
+	l.watch.publish(h.head, h.tail)
+	l.subs.notify(h.tail)
+	return nil
+}
+
+// refreshRetries bounds how often a read of a read-only log is retried
+// after the writer truncated the log underneath it.
+const refreshRetries = 4
+
+// retry reports whether a read that failed with err should be repeated,
+// attempt counts the retries so far. A read-only log is refreshed first,
+// after a pause if the writer is still truncating.
+func (l *Log) retry(err error, attempt int) bool {
+	if err != ErrTruncated || !l.opts.ReadOnly || attempt >= refreshRetries {
+		return false
+	}
+	if attempt > 0 {
+		time.Sleep(time.Duration(attempt) * time.Millisecond)
+	}
+	return l.Refresh() == nil
+}
+
+// poller calls Refresh periodically on a read-only log.
+type poller struct {
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func (p *poller) start(l *Log, d time.Duration) {
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+		t := time.NewTicker(d)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				l.Refresh()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// close stops the poller and waits for it to exit, concurrent calls all
+// wait.
+func (p *poller) close() {
+	if p.stop == nil {
+		return
+	}
+	p.once.Do(func() {
+		close(p.stop)
+		<-p.done
+	})
+}
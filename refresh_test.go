@@ -0,0 +1,113 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalReadOnlyFollow(t *testing.T) {
+	w, path := tempLog(t, &Option{NoSync: true})
+	w.Write(tables[1].data)
+
+	r := openLog(t, path, &Option{ReadOnly: true, RefreshInterval: -1})
+	assert.Equal(t, uint64(1), r.LastIndex(), "last index")
+	assert.Equal(t, ErrReadOnly, r.Write([]byte("x")), "write")
+	assert.Equal(t, ErrReadOnly, r.TruncateBack(0), "truncate")
+
+	for i := uint64(2); i <= uint64(len(tables)); i++ {
+		w.Write(tables[i].data)
+	}
+	_, err := r.Read(2)
+	assert.Equal(t, ErrNotFound, err, "not refreshed")
+	s := r.Subscribe()
+	assert.Equal(t, nil, r.Refresh(), "refresh")
+	assert.Equal(t, uint64(len(tables)), <-s.C, "notified on refresh")
+	for i := uint64(1); i <= uint64(len(tables)); i++ {
+		data, err := r.Read(i)
+		assert.Equal(t, nil, err, "read")
+		assert.Equal(t, tables[i].data, data, "data")
+	}
+
+	w.TruncateBack(2)
+	r.Refresh()
+	assert.Equal(t, uint64(2), r.LastIndex(), "truncated")
+	_, err = r.Read(3)
+	assert.Equal(t, ErrNotFound, err, "truncated record")
+	s.Unsubscribe()
+	r.Close()
+
+	r = openLog(t, path, &Option{ReadOnly: true, RefreshInterval: time.Millisecond})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	f := r.Follow(ctx, 3)
+	w.Write([]byte("followed"))
+	assert.Equal(t, true, f.Next(), "follow")
+	assert.Equal(t, []byte("followed"), f.Value(), "followed data")
+	f.Close()
+	r.Close()
+
+	big := bytes.Repeat([]byte("w"), 1<<14)
+	w.Write(big)
+	w.Write(big)
+	r = openLog(t, path, &Option{ReadOnly: true, RefreshInterval: -1})
+	item, err := r.writer.Item(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.TruncateFront(4)
+	_, err = r.writer.ReadRecord(int64(item.offset), item.prev)
+	assert.Equal(t, ErrTruncated, err, "offset taken before the truncation")
+	data, err := r.Read(5)
+	assert.Equal(t, nil, err, "read retried")
+	assert.Equal(t, big, data, "moved record")
+	assert.Equal(t, uint64(4), r.FirstIndex(), "refreshed by the read")
+
+	// a writer that stopped in the middle of a truncation
+	h, _ := w.writer.Header()
+	h.gen++
+	w.writer.WriteAt(h.Marshal(), 0)
+	_, err = r.Read(4)
+	assert.Equal(t, ErrTruncated, err, "truncation running")
+	w.Close()
+	w = openLog(t, path, &Option{NoSync: true})
+	h, _ = w.writer.Header()
+	assert.Equal(t, uint32(0), h.gen&1, "interrupted truncation repaired")
+	data, err = r.Read(4)
+	assert.Equal(t, nil, err, "read after the repair")
+	assert.Equal(t, big, data, "data after the repair")
+
+	item, _ = r.writer.Item(5)
+	w.TruncateBack(4)
+	_, err = r.writer.ReadRecord(int64(item.offset), item.prev)
+	assert.Equal(t, ErrTruncated, err, "read past the end of the file")
+	_, err = r.Read(5)
+	assert.Equal(t, ErrNotFound, err, "truncated underneath the read")
+
+	_, err = Open(filepath.Join(t.TempDir(), "missing"), &Option{ReadOnly: true})
+	assert.Equal(t, true, errors.Is(err, os.ErrNotExist), "no file")
+}
+
+func TestWalReadOnlyConcurrentClose(t *testing.T) {
+	l, path := tempLog(t, nil)
+	writeTables(t, l)
+	r, err := Open(path, &Option{ReadOnly: true, RefreshInterval: time.Millisecond})
+	assert.Equal(t, nil, err, "open")
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() { errs <- r.Close() }()
+	}
+	closed := 0
+	for i := 0; i < cap(errs); i++ {
+		if <-errs == nil {
+			closed++
+		}
+	}
+	assert.Equal(t, 1, closed, "closed once")
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2022 mobus sunsc0220@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import "sync"
+
+// Subscription receives the last index of the log after each durable
+// commit. C holds at most one pending value: a slow subscriber misses
+// intermediate indexes but always gets the latest one, and the writer
+// never waits for it.
+type Subscription struct {
+	C <-chan uint64
+
+	c    chan uint64
+	subs *subscribers
+}
+
+// Subscribe registers a new subscription to the commits of the log. C is
+// closed when the log is, at once if it already is.
+func (l *Log) Subscribe() *Subscription {
+	c := make(chan uint64, 1)
+	s := &Subscription{C: c, c: c, subs: &l.subs}
+	l.subs.add(s)
+	return s
+}
+
+// Unsubscribe removes the subscription and closes C, it is a no-op once
+// the log is closed.
+func (s *Subscription) Unsubscribe() {
+	s.subs.remove(s)
+}
+
+type subscribers struct {
+	mu     sync.Mutex
+	m      map[*Subscription]struct{}
+	last   uint64
+	closed bool
+}
+
+func (ss *subscribers) add(s *Subscription) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.closed {
+		close(s.c)
+		return
+	}
+	if ss.m == nil {
+		ss.m = make(map[*Subscription]struct{})
+	}
+	ss.m[s] = struct{}{}
+}
+
+func (ss *subscribers) remove(s *Subscription) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if _, ok := ss.m[s]; ok {
+		delete(ss.m, s)
+		close(s.c)
+	}
+}
+
+// close closes the channels of all subscriptions.
+func (ss *subscribers) close() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.closed = true
+	for s := range ss.m {
+		close(s.c)
+	}
+	ss.m = nil
+}
+
+// notify hands last to every subscription, replacing a value that has
+// not been received yet. Concurrent syncs can finish out of order, an
+// index that is not past the last notified one is dropped.
+func (ss *subscribers) notify(last uint64) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if last <= ss.last {
+		return
+	}
+	ss.last = last
+	for s := range ss.m {
+		select {
+		case s.c <- last:
+			continue
+		default:
+		}
+		select {
+		case <-s.c:
+		default:
+		}
+		select {
+		case s.c <- last:
+		default:
+		}
+	}
+}
+
+// rewind lets notify go below the last notified index after a truncation.
+func (ss *subscribers) rewind(last uint64) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if last < ss.last {
+		ss.last = last
+	}
+}
@@ -0,0 +1,54 @@
+package wal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalSubscribe(t *testing.T) {
+	l, path := tempLog(t, nil)
+
+	s := l.Subscribe()
+	slow := l.Subscribe()
+	for i := uint64(1); i <= uint64(len(tables)); i++ {
+		l.Write(tables[i].data)
+		assert.Equal(t, i, <-s.C, "committed index")
+	}
+	assert.Equal(t, uint64(len(tables)), <-slow.C, "latest index only")
+
+	slow.Unsubscribe()
+	slow.Unsubscribe()
+	_, ok := <-slow.C
+	assert.Equal(t, false, ok, "closed on unsubscribe")
+
+	l.Close()
+	l = openLog(t, path, &Option{NoSync: true})
+	s = l.Subscribe()
+	l.Write([]byte("not synced"))
+	select {
+	case <-s.C:
+		t.Error("notified before sync")
+	default:
+	}
+	l.Sync()
+	assert.Equal(t, uint64(len(tables))+1, <-s.C, "notified on sync")
+	s.Unsubscribe()
+}
+
+func TestWalSubscribeClose(t *testing.T) {
+	l, _ := tempLog(t, nil)
+	s := l.Subscribe()
+	done := make(chan struct{})
+	go func() {
+		for range s.C {
+		}
+		close(done)
+	}()
+	l.Write(tables[1].data)
+	assert.Equal(t, nil, l.Close(), "close")
+	<-done
+	s.Unsubscribe()
+	_, ok := <-l.Subscribe().C
+	assert.Equal(t, false, ok, "subscribed after close")
+}
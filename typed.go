@@ -0,0 +1,191 @@
+// Copyright (c) 2022 mobus sunsc0220@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// Codec converts values of T to and from record data.
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// JSONCodec encodes values with encoding/json.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// GobCodec encodes values with encoding/gob, every record carries its own
+// type description.
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
+
+// CodecError wraps an error returned by a Codec, errors of the log itself
+// are returned as they are. Index is 0 when encoding failed.
+type CodecError struct {
+	Index uint64
+	Err   error
+}
+
+func (e *CodecError) Error() string {
+	if e.Index == 0 {
+		return fmt.Sprintf("codec: %v", e.Err)
+	}
+	return fmt.Sprintf("codec: index %d: %v", e.Index, e.Err)
+}
+
+func (e *CodecError) Unwrap() error {
+	return e.Err
+}
+
+// TypedLog stores values of T in a Log through a Codec.
+type TypedLog[T any] struct {
+	log   *Log
+	codec Codec[T]
+}
+
+// NewTypedLog wraps l so that its records hold values of T.
+func NewTypedLog[T any](l *Log, codec Codec[T]) *TypedLog[T] {
+	return &TypedLog[T]{log: l, codec: codec}
+}
+
+// Log returns the underlying log.
+func (t *TypedLog[T]) Log() *Log {
+	return t.log
+}
+
+// Append writes v and returns its index.
+func (t *TypedLog[T]) Append(v T) (uint64, error) {
+	first, _, err := t.AppendBatch(v)
+	return first, err
+}
+
+// AppendBatch writes vs atomically and returns their index range.
+func (t *TypedLog[T]) AppendBatch(vs ...T) (first, last uint64, err error) {
+	b := &Batch{}
+	for _, v := range vs {
+		data, err := t.codec.Encode(v)
+		if err != nil {
+			return 0, 0, &CodecError{Err: err}
+		}
+		b.Add(data)
+	}
+	return t.log.WriteBatch(b)
+}
+
+// Get reads the value at idx.
+func (t *TypedLog[T]) Get(idx uint64) (T, error) {
+	lease := t.log.Lease()
+	defer lease.Release()
+	var v T
+	data, err := t.log.Read(idx)
+	if err != nil {
+		return v, err
+	}
+	v, err = t.codec.Decode(data)
+	if err != nil {
+		return v, &CodecError{Index: idx, Err: err}
+	}
+	return v, nil
+}
+
+// Iterator returns an iterator over the values in [from, to].
+func (t *TypedLog[T]) Iterator(from, to uint64) *TypedIterator[T] {
+	return &TypedIterator[T]{t: t, it: t.log.Iterator(from, to)}
+}
+
+// TypedIterator walks the values of a TypedLog, a value that fails to
+// decode stops it with a *CodecError.
+type TypedIterator[T any] struct {
+	t   *TypedLog[T]
+	it  *Iterator
+	v   T
+	err error
+}
+
+// Reverse makes the iterator walk backwards, see Iterator.Reverse.
+func (ti *TypedIterator[T]) Reverse() *TypedIterator[T] {
+	ti.it.Reverse()
+	return ti
+}
+
+// Next advances to the next value.
+func (ti *TypedIterator[T]) Next() bool {
+	if ti.err != nil {
+		return false
+	}
+	lease := ti.t.log.Lease()
+	defer lease.Release()
+	if !ti.it.Next() {
+		return false
+	}
+	v, err := ti.t.codec.Decode(ti.it.Value())
+	if err != nil {
+		ti.err = &CodecError{Index: ti.it.Index(), Err: err}
+		return false
+	}
+	ti.v = v
+	return true
+}
+
+// Index returns the index of the current value.
+func (ti *TypedIterator[T]) Index() uint64 {
+	return ti.it.Index()
+}
+
+// Value returns the current value.
+func (ti *TypedIterator[T]) Value() T {
+	return ti.v
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (ti *TypedIterator[T]) Err() error {
+	if ti.err != nil {
+		return ti.err
+	}
+	return ti.it.Err()
+}
+
+// Close releases the iterator.
+func (ti *TypedIterator[T]) Close() error {
+	return ti.it.Close()
+}
@@ -0,0 +1,62 @@
+package wal
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testEvent struct {
+	ID   int
+	Name string
+}
+
+func TestTypedLog(t *testing.T) {
+	for name, codec := range map[string]Codec[testEvent]{
+		"json": JSONCodec[testEvent]{},
+		"gob":  GobCodec[testEvent]{},
+	} {
+		l, _ := tempLog(t, nil)
+		tl := NewTypedLog[testEvent](l, codec)
+
+		idx, err := tl.Append(testEvent{ID: 1, Name: "first"})
+		assert.Equal(t, nil, err, name)
+		assert.Equal(t, uint64(1), idx, name)
+		first, last, err := tl.AppendBatch(testEvent{ID: 2, Name: "second"}, testEvent{ID: 3, Name: "third"})
+		assert.Equal(t, nil, err, name)
+		assert.Equal(t, uint64(2), first, name)
+		assert.Equal(t, uint64(3), last, name)
+
+		v, err := tl.Get(2)
+		assert.Equal(t, nil, err, name)
+		assert.Equal(t, testEvent{ID: 2, Name: "second"}, v, name)
+		_, err = tl.Get(4)
+		assert.Equal(t, ErrNotFound, err, name)
+
+		var ids []int
+		it := tl.Iterator(1, 3).Reverse()
+		for it.Next() {
+			assert.Equal(t, it.Index(), uint64(it.Value().ID), name)
+			ids = append(ids, it.Value().ID)
+		}
+		assert.Equal(t, nil, it.Err(), name)
+		assert.Equal(t, []int{3, 2, 1}, ids, name)
+
+		l.Write([]byte("not an event"))
+		_, err = tl.Get(4)
+		var cerr *CodecError
+		assert.Equal(t, true, errors.As(err, &cerr), name)
+		assert.Equal(t, uint64(4), cerr.Index, name)
+		it = tl.Iterator(3, 4)
+		assert.Equal(t, true, it.Next(), name)
+		assert.Equal(t, false, it.Next(), name)
+		assert.Equal(t, true, errors.As(it.Err(), &cerr), name)
+	}
+
+	l, _ := tempLog(t, nil)
+	_, err := NewTypedLog[chan int](l, JSONCodec[chan int]{}).Append(make(chan int))
+	var cerr *CodecError
+	assert.Equal(t, true, errors.As(err, &cerr), "encode")
+	assert.Equal(t, uint64(0), l.LastIndex(), "nothing written")
+}
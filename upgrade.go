@@ -0,0 +1,121 @@
+// Copyright (c) 2022 mobus sunsc0220@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Upgrade rewrites the log at path in the format version opts.FormatVersion,
+// 0 meaning the one Open gives new files, keeping the indexes of its committed records
+// and the mode of the file. Logs already in that version or a newer one
+// are left as they are. The Encryption and Compression of opts are used
+// to read the old records and to write the new ones. The new file is
+// written and synced next to the old one and then renamed over it, so a
+// crash leaves either of them in place. The log must not be open for
+// writing meanwhile.
+func Upgrade(path string, opts *Option) error {
+	if opts == nil {
+		opts = defaultOption
+	}
+	target := opts.FormatVersion
+	if target == 0 {
+		target = formatVersion
+	}
+	if target < formatV1 || target > formatLatest {
+		return ErrVersion
+	}
+	src, err := Open(path, &Option{
+		ReadOnly:        true,
+		RefreshInterval: -1,
+		Encryption:      opts.Encryption,
+	})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if src.writer.Version() >= target {
+		return nil
+	}
+	info, err := src.writer.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".upgrade"
+	os.Remove(tmp)
+	dst, err := Open(tmp, &Option{
+		NoSync:        true,
+		AllowGaps:     true,
+		Compression:   opts.Compression,
+		CompressMin:   opts.CompressMin,
+		Encryption:    opts.Encryption,
+		FormatVersion: target,
+	})
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp, info.Mode().Perm())
+	if err == nil {
+		err = upgrade(src, dst)
+	}
+	if err == nil {
+		err = dst.Close()
+	} else {
+		dst.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func upgrade(src, dst *Log) error {
+	if src.FirstIndex() > 0 {
+		e := src.Export(src.FirstIndex(), src.LastIndex())
+		defer e.Close()
+		_, err := dst.Import(e)
+		if err != nil {
+			return err
+		}
+	}
+	if dst.LastIndex() != src.LastIndex() {
+		// an emptied log keeps counting from its last index
+		h, err := dst.writer.Header()
+		if err != nil {
+			return err
+		}
+		h.tail = src.LastIndex()
+		_, err = dst.writer.WriteAt(h.Marshal(), 0)
+		if err != nil {
+			return err
+		}
+	}
+	return dst.Sync()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,115 @@
+package wal
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fileVersion returns the format version in the header of the file at path.
+func fileVersion(t *testing.T, path string) uint64 {
+	t.Helper()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &header{}
+	h.Unmarshal(raw)
+	return h.version
+}
+
+func TestWalUpgrade(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	_, err := Open(path, &Option{FormatVersion: 9})
+	assert.Equal(t, ErrVersion, err, "unknown version")
+
+	l := openLog(t, path, &Option{FormatVersion: formatV1, AllowGaps: true})
+	for i := uint64(1); i <= uint64(len(tables)); i++ {
+		l.WriteAt(i*2, tables[i].data)
+	}
+	assert.Equal(t, ErrOldFormat, l.WriteWithMeta([]byte("x"), map[string]string{"k": "v"}), "no attributes")
+	l.Close()
+	assert.Equal(t, uint64(formatV1), fileVersion(t, path), "written in version 1")
+
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ErrVersion, Upgrade(path, &Option{FormatVersion: 9}), "unknown target")
+	assert.Equal(t, nil, Upgrade(path, &Option{FormatVersion: formatV2}), "upgrade to version 2")
+	assert.Equal(t, uint64(formatV2), fileVersion(t, path), "upgraded to version 2")
+	_, err = os.Stat(path + ".upgrade")
+	assert.Equal(t, true, os.IsNotExist(err), "no leftovers")
+	checkUpgraded(t, path)
+	assert.Equal(t, nil, Upgrade(path, &Option{FormatVersion: formatV1}), "older target")
+	assert.Equal(t, uint64(formatV2), fileVersion(t, path), "older target kept")
+
+	assert.Equal(t, nil, Upgrade(path, nil), "default target")
+	assert.Equal(t, uint64(formatVersion), fileVersion(t, path), "default target of new files")
+
+	latest := &Option{FormatVersion: formatLatest}
+	assert.Equal(t, nil, Upgrade(path, latest), "upgrade to latest")
+	assert.Equal(t, uint64(formatLatest), fileVersion(t, path), "upgraded to latest")
+	checkUpgraded(t, path)
+	assert.Equal(t, nil, Upgrade(path, latest), "current version")
+
+	// version 1 straight to the latest
+	path = filepath.Join(t.TempDir(), "wal")
+	l = openLog(t, path, &Option{FormatVersion: formatV1, AllowGaps: true})
+	for i := uint64(1); i <= uint64(len(tables)); i++ {
+		l.WriteAt(i*2, tables[i].data)
+	}
+	l.Close()
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, nil, Upgrade(path, latest), "upgrade from version 1")
+	assert.Equal(t, uint64(formatLatest), fileVersion(t, path), "upgraded from version 1")
+	checkUpgraded(t, path)
+	l = openLog(t, path, nil)
+	assert.Equal(t, nil, l.WriteTombstone(2), "tombstones after upgrade")
+	l.Close()
+
+	// an emptied log keeps its last index
+	path = filepath.Join(t.TempDir(), "wal")
+	l = openLog(t, path, &Option{FormatVersion: formatV1})
+	l.WriteAt(5, tables[1].data)
+	l.Write(tables[2].data)
+	l.TruncateBack(4)
+	l.Close()
+	assert.Equal(t, nil, Upgrade(path, nil), "upgrade emptied")
+	l = openLog(t, path, nil)
+	l.Write(tables[3].data)
+	assert.Equal(t, uint64(5), l.LastIndex(), "continues after the last index")
+	l.Close()
+
+	raw, _ := os.ReadFile(path)
+	binary.BigEndian.PutUint64(raw, 9)
+	if err := os.WriteFile(path, raw, 0664); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open(path, nil)
+	assert.Equal(t, ErrVersion, err, "newer version")
+	assert.Equal(t, ErrVersion, Upgrade(path, nil), "upgrade newer version")
+}
+
+// checkUpgraded checks the log at path written by TestWalUpgrade.
+func checkUpgraded(t *testing.T, path string) {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "mode kept")
+	l := openLog(t, path, nil)
+	defer l.Close()
+	assert.Equal(t, uint64(2), l.FirstIndex(), "first index")
+	assert.Equal(t, uint64(2*len(tables)), l.LastIndex(), "last index")
+	for i := uint64(1); i <= uint64(len(tables)); i++ {
+		data, err := l.Read(i * 2)
+		assert.Equal(t, nil, err, "read")
+		assert.Equal(t, tables[i].data, data, "data")
+	}
+}
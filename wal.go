@@ -1,40 +1,224 @@
 package wal
 
 import (
+	"context"
+	"encoding/binary"
+	"io"
 	"sync"
-
-	"github.com/sunvim/utils/cachem"
+	"sync/atomic"
 )
 
+var _ IWal = (*Log)(nil)
+
+// Log is safe for concurrent use. Appends and truncations are serialised
+// by wmu, readers only see records once the last index covers them.
 type Log struct {
 	opts      *Option
-	writer    IFile
-	fistIndex uint64
-	lastIndex uint64
+	writer    recordFile
+	wmu       sync.Mutex
+	closed    atomic.Bool
+	fistIndex atomic.Uint64
+	lastIndex atomic.Uint64
+	leases    leaseTable
+	watch     watch
+	subs      subscribers
+	async     asyncWriter
+	poller    poller
+	pending   pending
+	bloom     blooms
+
+	// smu is held shared by syncs, Close takes it to wait for them.
+	// syncErr keeps the error of a sync whose caller gave up on it
+	smu     sync.RWMutex
+	syncErr atomic.Pointer[error]
 }
 
 func Open(path string, opts *Option) (*Log, error) {
 	var err error
 
-	l := &Log{}
-	l.writer, err = OpenFile(path, opts)
+	if opts == nil {
+		opts = defaultOption
+	}
+	if c := opts.Compression; c != nil && lookupCompressor(c.ID()) == nil {
+		return nil, ErrCompressor
+	}
+	l := &Log{opts: opts}
+	if !opts.ReadOnly {
+		err = l.bloom.init(opts.BloomFalsePositive)
+		if err != nil {
+			return nil, err
+		}
+	}
+	f, err := OpenFile(path, opts)
 	if err != nil {
 		return nil, err
 	}
+	var ok bool
+	l.writer, ok = f.(recordFile)
+	if !ok {
+		f.Close()
+		return nil, ErrNotSupported
+	}
 
 	err = l.writer.Check()
 	if err != nil {
+		l.writer.Close()
 		return nil, err
 	}
 	head, _ := l.writer.Header()
-	l.fistIndex = head.head
-	l.lastIndex = head.tail
+	l.fistIndex.Store(head.head)
+	l.lastIndex.Store(head.tail)
+
+	err = l.recover()
+	if err != nil {
+		l.writer.Close()
+		return nil, err
+	}
+	l.watch.publish(l.fistIndex.Load(), l.lastIndex.Load())
+	if opts.ReadOnly {
+		d := opts.RefreshInterval
+		if d == 0 {
+			d = defaultRefreshInterval
+		}
+		if d > 0 {
+			l.poller.start(l, d)
+		}
+	}
 
 	return l, nil
 }
 
+// recover discards frames past the header tail, they belong to a write or
+// truncation that was interrupted around the header update. It also cuts
+// the file at the first torn frame, the pages of a write may reach the
+// disk in any order, and moves the tail back to the last intact record.
+// A frame whose index does not follow the one before is torn too, it is
+// left by a Replace journal that never completed. It takes the first
+// index from the records when the header has no head.
+//
+// An odd generation is left by an interrupted truncation. OpenFile has
+// finished the move of TruncateFront by then, recover takes the head from
+// the first frame and makes the generation even. Truncations sync the
+// records before they start, so torn frames below the tail under an odd
+// generation mean the file was damaged otherwise, recover then fails with
+// ErrTorn and leaves the file alone. A read-only log leaves the frames to
+// the writer, it ignores them anyway.
+func (l *Log) recover() error {
+	items, err := l.writer.CheckedItems()
+	if err != nil {
+		return err
+	}
+	if len(items) > 0 && l.fistIndex.Load() == 0 {
+		l.fistIndex.Store(items[0].index)
+	}
+	if l.opts.ReadOnly {
+		return nil
+	}
+	h, err := l.writer.Header()
+	if err != nil {
+		return err
+	}
+	var (
+		end  int64 = HeaderSize
+		last uint64
+		kept int
+		torn = true
+	)
+	for _, item := range items {
+		if item.index > h.tail {
+			torn = false
+			break
+		}
+		if kept > 0 && item.index <= last {
+			break
+		}
+		end = int64(item.offset + item.length)
+		last = item.index
+		kept++
+	}
+	items = items[:kept]
+	cut := end < l.writer.Size()
+	interrupted := h.gen&1 != 0
+	fix := interrupted
+	if cut && torn && last < h.tail {
+		if interrupted {
+			return ErrTorn
+		}
+		switch {
+		case last > 0:
+			h.tail = last
+		case h.head > 0:
+			// the first records of an emptied log are all torn
+			h.tail, h.head = h.head-1, 0
+			l.fistIndex.Store(0)
+		}
+		l.lastIndex.Store(h.tail)
+		fix = true
+	}
+	if interrupted && len(items) > 0 && items[0].index > h.head {
+		h.head = items[0].index
+		l.fistIndex.Store(h.head)
+	}
+	if fix {
+		h.gen += h.gen & 1
+		_, err = l.writer.WriteAt(h.Marshal(), 0)
+		if err == nil {
+			err = l.writer.Sync()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	l.bloom.reset(items, h.tail)
+	if cut {
+		return l.truncate(end)
+	}
+	return nil
+}
+
+// truncate cuts the file at end and moves the write offset there.
+func (l *Log) truncate(end int64) error {
+	err := l.writer.Truncate(end)
+	if err != nil {
+		return err
+	}
+	_, err = l.writer.Seek(end, io.SeekStart)
+	return err
+}
+
+// FirstIndex returns the index of the first record, 0 if the log is empty.
+func (l *Log) FirstIndex() uint64 {
+	return l.fistIndex.Load()
+}
+
+// LastIndex returns the index of the last record.
+func (l *Log) LastIndex() uint64 {
+	return l.lastIndex.Load()
+}
+
+// Close closes the log once the syncs in flight are done. It returns the
+// error of a sync that outlived its context, if one failed. Close does
+// not wait for leases: while any is held the mapping stays in place, and
+// the release of the last one closes the file.
 func (l *Log) Close() error {
-	return l.writer.Close()
+	l.async.stop()
+	l.poller.close()
+	l.smu.Lock()
+	defer l.smu.Unlock()
+	l.wmu.Lock()
+	if l.closed.Swap(true) {
+		l.wmu.Unlock()
+		return ErrClosed
+	}
+	l.watch.close()
+	l.subs.close()
+	// truncations lock the leases before wmu
+	l.wmu.Unlock()
+	err := l.leases.close(l.writer.Close)
+	if p := l.syncErr.Load(); p != nil && err == nil {
+		err = *p
+	}
+	return err
 }
 
 var (
@@ -46,74 +230,587 @@ var (
 )
 
 func (l *Log) Write(data []byte) error {
+	return l.WriteContext(context.Background(), data)
+}
+
+// WriteContext is Write bounded by ctx. Once the record is committed ctx
+// only bounds the sync, an error then means the record is in the log but
+// may not be durable yet.
+func (l *Log) WriteContext(ctx context.Context, data []byte) error {
+	return l.write(ctx, RecordIns, data, nil)
+}
+
+// WriteWithMeta appends data along with the metadata attributes attrs,
+// which are returned by ReadEntry and Iterator.Meta. Records written
+// without attributes take no space for them. Files in format version 1
+// cannot hold attributes.
+func (l *Log) WriteWithMeta(data []byte, attrs map[string]string) error {
+	return l.WriteWithMetaContext(context.Background(), data, attrs)
+}
+
+// WriteWithMetaContext is WriteWithMeta bounded by ctx, like WriteContext.
+func (l *Log) WriteWithMetaContext(ctx context.Context, data []byte, attrs map[string]string) error {
+	return l.write(ctx, RecordIns, data, attrs)
+}
+
+// WriteTombstone appends a RecordDel record marking the record idx as
+// deleted, its data holds idx as 8 bytes big endian. The record idx stays
+// readable, honouring the tombstone is up to the reader. Files in format
+// version 1 cannot hold tombstones.
+func (l *Log) WriteTombstone(idx uint64) error {
+	return l.WriteTombstoneContext(context.Background(), idx)
+}
+
+// WriteTombstoneContext is WriteTombstone bounded by ctx, like
+// WriteContext.
+func (l *Log) WriteTombstoneContext(ctx context.Context, idx uint64) error {
+	if !l.contains(idx) {
+		return ErrNotFound
+	}
+	return l.write(ctx, RecordDel, binary.BigEndian.AppendUint64(nil, idx), nil)
+}
+
+// write appends a record of type op at the next index.
+func (l *Log) write(ctx context.Context, op OpType, data []byte, attrs map[string]string) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	err = l.pending.acquire(ctx, l.opts, 1, frameSize(len(data)))
+	if err != nil {
+		return err
+	}
+	defer l.pending.release(1, frameSize(len(data)))
 	r, _ := rpool.Get().(*Record)
 	defer rpool.Put(r)
-	r.index = l.lastIndex + 1
 	r.data = data
+	r.op = op
+	r.attrs = attrs
+	cr, err := l.compress(r, l.writer.Version())
+	if err != nil {
+		return err
+	}
+	l.wmu.Lock()
+	cr.index = l.lastIndex.Load() + 1
+	cr.prev = l.prevIndex()
+	b, err := l.frame(cr)
+	if err == nil {
+		err = l.append(b, []uint64{cr.index})
+	}
+	l.wmu.Unlock()
+	if err != nil {
+		return err
+	}
+	return l.commit(ctx)
+}
+
+// WriteAt appends data with the caller supplied index idx. idx must be
+// greater than the last index, and exactly one greater unless
+// Option.AllowGaps is set. An empty log accepts any idx as its base.
+func (l *Log) WriteAt(idx uint64, data []byte) error {
+	return l.WriteAtContext(context.Background(), idx, data)
+}
+
+// WriteAtContext is WriteAt bounded by ctx, like WriteContext.
+func (l *Log) WriteAtContext(ctx context.Context, idx uint64, data []byte) error {
+	if l.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	err = l.pending.acquire(ctx, l.opts, 1, frameSize(len(data)))
+	if err != nil {
+		return err
+	}
+	defer l.pending.release(1, frameSize(len(data)))
+	r, _ := rpool.Get().(*Record)
+	defer rpool.Put(r)
+	r.index = idx
+	r.data = data
+	r.op = RecordIns
+	r.attrs = nil
+	cr, err := l.compress(r, l.writer.Version())
+	if err != nil {
+		return err
+	}
+	l.wmu.Lock()
+	err = l.checkIndex(idx, l.lastIndex.Load(), l.writer.Size() == HeaderSize)
+	if err == nil {
+		cr.prev = l.prevIndex()
+		var b []byte
+		b, err = l.frame(cr)
+		if err == nil {
+			err = l.append(b, []uint64{idx})
+		}
+	}
+	l.wmu.Unlock()
+	if err != nil {
+		return err
+	}
+	return l.commit(ctx)
+}
+
+// prevIndex returns the index of the last frame in the file, which the
+// next appended frame follows, 0 if there is none. The caller holds wmu.
+func (l *Log) prevIndex() uint64 {
+	return l.writer.TailIndex()
+}
+
+// checkIndex validates idx as the index following prev, an empty log
+// accepts any index as its base.
+func (l *Log) checkIndex(idx, prev uint64, empty bool) error {
+	if idx == 0 {
+		return ErrInvalidIndex
+	}
+	if empty {
+		return nil
+	}
+	if idx <= prev {
+		return ErrOutOfOrder
+	}
+	if idx != prev+1 && !l.opts.AllowGaps {
+		return ErrIndexGap
+	}
+	return nil
+}
+
+// append writes framed records and then commits them by storing last as
+// the header tail. Open discards frames past the tail, so a crash before
+// the header update leaves none of them visible. The pages of the frames
+// and the header may reach the disk in any order, Open also cuts torn
+// frames by their checksums. Version 1 frames have none, they are synced
+// before the header is written unless Option.NoSync is set. idxs are the
+// indexes of the frames in order, the first records of an empty log also
+// set the head to the first of them. They go to the bloom filters once
+// committed. The caller holds wmu.
+func (l *Log) append(frames []byte, idxs []uint64) error {
+	if l.closed.Load() {
+		return ErrClosed
+	}
+	if l.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	first, last := idxs[0], idxs[len(idxs)-1]
+	start := l.writer.Size()
+	_, err := l.writer.Write(frames)
+	if err == nil && l.writer.Version() < formatV2 && !l.opts.NoSync {
+		err = l.writer.Sync()
+	}
+	if err != nil {
+		l.truncate(start)
+		return err
+	}
 	head, err := l.writer.Header()
+	if err == nil {
+		if start == HeaderSize {
+			head.head = first
+		}
+		head.tail = last
+		_, err = l.writer.WriteAt(head.Marshal(), 0)
+	}
 	if err != nil {
+		l.truncate(start)
 		return err
 	}
-	head.tail = r.index
-	_, err = l.writer.WriteAt(head.Marshal(), 0)
+	for _, idx := range idxs {
+		l.bloom.add(idx)
+	}
+	if start == HeaderSize {
+		l.fistIndex.Store(first)
+	}
+	l.lastIndex.Store(last)
+	l.watch.publish(l.fistIndex.Load(), l.lastIndex.Load())
+	return nil
+}
+
+// commit syncs appended records unless Option.NoSync is set.
+func (l *Log) commit(ctx context.Context) error {
+	if l.opts.NoSync {
+		return nil
+	}
+	return l.SyncContext(ctx)
+}
+
+// Sync flushes the log to disk and notifies subscribers of the last index.
+func (l *Log) Sync() error {
+	return l.SyncContext(context.Background())
+}
+
+// SyncContext is Sync bounded by ctx. The flush cannot be interrupted, it
+// carries on in the background when ctx is done first. Close waits for
+// it and returns its error.
+func (l *Log) SyncContext(ctx context.Context) error {
+	err := ctx.Err()
 	if err != nil {
 		return err
 	}
-	b, _ := r.Marshal()
-	_, err = l.writer.Write(b)
+	l.smu.RLock()
+	if ctx.Done() == nil {
+		defer l.smu.RUnlock()
+		return l.sync()
+	}
+	done := make(chan error)
+	abandon := make(chan struct{})
+	go func() {
+		defer l.smu.RUnlock()
+		err := l.sync()
+		select {
+		case done <- err:
+		case <-abandon:
+			if err != nil {
+				l.syncErr.CompareAndSwap(nil, &err)
+			}
+		}
+	}()
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		close(abandon)
+		return ctx.Err()
+	}
+}
+
+// sync flushes the file, the caller holds smu shared.
+func (l *Log) sync() error {
+	if l.closed.Load() {
+		return ErrClosed
+	}
+	last := l.lastIndex.Load()
+	err := l.writer.Sync()
 	if err != nil {
 		return err
 	}
-	l.lastIndex = r.index
+	l.subs.notify(last)
 	return nil
 }
 
 func (l *Log) Read(idx uint64) (data []byte, err error) {
-	item, err := l.writer.Item(idx)
+	return l.ReadContext(context.Background(), idx)
+}
+
+// ReadContext is Read with a lookup that stops when ctx is done.
+func (l *Log) ReadContext(ctx context.Context, idx uint64) (data []byte, err error) {
+	rec, err := l.read(ctx, idx, false)
 	if err != nil {
 		return nil, err
 	}
-	rec := &Record{}
-	buf := cachem.Malloc(int(item.length))
-	defer cachem.Free(buf)
-	l.writer.ReadAt(buf, int64(item.offset))
-	rec.Unmarshal(buf[RecordSize:])
 	return rec.data, nil
 }
 
+// Entry is a record along with its type and metadata attributes.
+type Entry struct {
+	Index uint64
+	Op    OpType
+	Data  []byte
+	Meta  map[string]string
+}
+
+// ReadEntry reads the record idx, a RecordDel entry is a tombstone
+// written by WriteTombstone.
+func (l *Log) ReadEntry(idx uint64) (*Entry, error) {
+	return l.ReadEntryContext(context.Background(), idx)
+}
+
+// ReadEntryContext is ReadEntry stopping when ctx is done.
+func (l *Log) ReadEntryContext(ctx context.Context, idx uint64) (*Entry, error) {
+	rec, err := l.read(ctx, idx, false)
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{Index: rec.index, Op: rec.op, Data: rec.data, Meta: rec.attrs}, nil
+}
+
+// ReadNoCopy reads the record idx without copying its data, which points
+// into the mapping of the log unless the record had to be decompressed or
+// decrypted. The data stays valid until the returned lease is released.
+func (l *Log) ReadNoCopy(idx uint64) ([]byte, *Lease, error) {
+	lease := l.Lease()
+	rec, err := l.read(context.Background(), idx, true)
+	if err != nil {
+		lease.Release()
+		return nil, nil, err
+	}
+	return rec.data, lease, nil
+}
+
+// read reads the record idx, with alias its data may point into the
+// mapping.
+func (l *Log) read(ctx context.Context, idx uint64, alias bool) (*Record, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+	if l.closed.Load() {
+		return nil, ErrClosed
+	}
+	for attempt := 0; ; attempt++ {
+		if !l.contains(idx) || !l.bloom.has(idx) {
+			return nil, ErrNotFound
+		}
+		rec, err := l.writer.ReadIndex(ctx, idx, alias)
+		if l.retry(err, attempt) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if rec.index != idx {
+			return nil, ErrNotFound
+		}
+		return rec, nil
+	}
+}
+
 func (l *Log) ReadBatch(idxes ...uint64) (map[uint64][]byte, error) {
 	if len(idxes) == 0 {
 		return nil, nil
 	}
 	m := make(map[uint64][]byte, len(idxes))
-	items, err := l.writer.Items()
-	if err != nil {
-		return nil, err
-	}
-	rec := &Record{}
-	for _, item := range items {
-		buf := cachem.Malloc(int(item.length))
-		l.writer.ReadAt(buf, int64(item.offset))
-		rec.Unmarshal(buf)
-		cachem.Free(buf)
-		for _, idx := range idxes {
-			if rec.index == idx {
-				m[idx] = rec.data
-			}
+	for _, idx := range idxes {
+		rec, err := l.read(context.Background(), idx, false)
+		if err == ErrNotFound {
+			continue
 		}
+		if err != nil {
+			return nil, err
+		}
+		m[idx] = rec.data
 	}
 	return m, nil
 }
 
+// ReadRange reads the records in [lo, hi] in one pass, stopping once the
+// data read reaches maxBytes. At least one record is returned even if it
+// alone exceeds the budget, maxBytes <= 0 means no limit. next is the
+// index to resume from. Like Read it returns copies, also with
+// Option.NoCopy.
+func (l *Log) ReadRange(lo, hi uint64, maxBytes int) (data [][]byte, next uint64, err error) {
+	return l.ReadRangeContext(context.Background(), lo, hi, maxBytes)
+}
+
+// ReadRangeContext is ReadRange stopping when ctx is done.
+func (l *Log) ReadRangeContext(ctx context.Context, lo, hi uint64, maxBytes int) (data [][]byte, next uint64, err error) {
+	if !l.contains(lo) || hi < lo {
+		return nil, lo, ErrNotFound
+	}
+	if hi > l.lastIndex.Load() {
+		hi = l.lastIndex.Load()
+	}
+	next = lo
+	size := 0
+	if l.opts.NoCopy {
+		lease := l.Lease()
+		defer lease.Release()
+	}
+	it := l.IteratorContext(ctx, lo, hi)
+	defer it.Close()
+	for it.Next() {
+		v := it.Value()
+		if l.opts.NoCopy {
+			v = append([]byte(nil), v...)
+		}
+		if maxBytes > 0 && len(data) > 0 && size+len(v) > maxBytes {
+			return data, next, nil
+		}
+		size += len(v)
+		data = append(data, v)
+		next = it.Index() + 1
+	}
+	if it.Err() != nil {
+		return data, next, it.Err()
+	}
+	return data, hi + 1, nil
+}
+
+// TruncateFront removes all records with an index lower than idx. It
+// waits for the leases on the log to be released.
 func (l *Log) TruncateFront(idx uint64) error {
-	item, err := l.writer.Item(idx)
+	return l.TruncateFrontContext(context.Background(), idx)
+}
+
+// TruncateFrontContext is TruncateFront giving up with the error of ctx
+// when ctx is done before the leases are released or the record idx is
+// found. Once the data is being moved it runs to the end.
+func (l *Log) TruncateFrontContext(ctx context.Context, idx uint64) error {
+	err := ctx.Err()
 	if err != nil {
 		return err
 	}
-	l.writer.Remove(HeaderSize, int64(item.offset))
-	h, _ := l.writer.Header()
-	h.head = idx
-	l.writer.WriteAt(h.Marshal(), 0)
+	err = l.leases.lockContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer l.leases.unlock()
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	if l.closed.Load() {
+		return ErrClosed
+	}
+	if l.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if !l.contains(idx) || !l.bloom.has(idx) {
+		return ErrNotFound
+	}
+	item, err := l.writer.Find(ctx, idx, false)
+	if err != nil {
+		return err
+	}
+	h, err := l.writer.Header()
+	if err != nil {
+		return err
+	}
+	// the records must be durable before the odd generation is, Open
+	// takes a torn frame under it for damage it cannot repair
+	err = l.writer.Sync()
+	if err == nil {
+		err = l.bump(h)
+	}
+	if err != nil {
+		return err
+	}
+	if l.writer.Version() >= formatV3 {
+		err = l.rebase(item)
+	} else {
+		err = l.writer.Replace(HeaderSize, int64(item.offset), nil)
+	}
+	if err == nil {
+		h.head = idx
+	}
+	if berr := l.bump(h); err == nil {
+		err = berr
+	}
+	if err != nil {
+		return err
+	}
+	l.fistIndex.Store(idx)
+	l.bloom.truncateFront(idx)
+	l.watch.publish(l.fistIndex.Load(), l.lastIndex.Load())
+
+	return nil
+}
+
+// TruncateBack removes all records with an index greater than idx.
+//
+// The new tail is committed to the header and synced before the file is
+// cut, a crash in between is repaired by Open discarding the frames past
+// the tail.
+func (l *Log) TruncateBack(idx uint64) error {
+	return l.TruncateBackContext(context.Background(), idx)
+}
 
+// TruncateBackContext is TruncateBack giving up with the error of ctx
+// when ctx is done before the leases are released or the new end of the
+// file is found. Once the header is updated it runs to the end.
+func (l *Log) TruncateBackContext(ctx context.Context, idx uint64) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	err = l.leases.lockContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer l.leases.unlock()
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	if l.closed.Load() {
+		return ErrClosed
+	}
+	if l.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if idx >= l.lastIndex.Load() {
+		return nil
+	}
+	var end int64 = HeaderSize
+	if idx >= l.fistIndex.Load() && idx > 0 {
+		item, err := l.writer.Find(ctx, idx, true)
+		if err != nil {
+			return err
+		}
+		end = int64(item.offset + item.length)
+	}
+	h, err := l.writer.Header()
+	if err != nil {
+		return err
+	}
+	h.tail = idx
+	if end == HeaderSize {
+		h.head = 0
+	}
+	err = l.writer.Sync()
+	if err == nil {
+		err = l.bump(h)
+	}
+	if err != nil {
+		return err
+	}
+	err = l.writer.Sync()
+	if err == nil {
+		err = l.truncate(end)
+	}
+	if berr := l.bump(h); err == nil {
+		err = berr
+	}
+	if err != nil {
+		return err
+	}
+	l.fistIndex.Store(h.head)
+	l.lastIndex.Store(idx)
+	l.bloom.truncateBack(idx)
+	l.subs.rewind(idx)
+	l.watch.publish(l.fistIndex.Load(), l.lastIndex.Load())
 	return nil
 }
+
+// bump advances the generation of h and writes h, a truncation bumps it
+// before and after it moves or cuts frames. Version 1 files keep
+// generation 0.
+func (l *Log) bump(h *header) error {
+	if l.writer.Version() >= formatV2 {
+		h.gen++
+	}
+	_, err := l.writer.WriteAt(h.Marshal(), 0)
+	return err
+}
+
+// contains reports whether idx falls in [first, last], so lookups for
+// indexes the log cannot hold return without scanning the file.
+func (l *Log) contains(idx uint64) bool {
+	if idx == 0 || idx > l.lastIndex.Load() {
+		return false
+	}
+	return idx >= l.fistIndex.Load()
+}
+
+// rebase rewrites the frame of item as the first of the file, in place of
+// everything before it. Compact frames store the index of a record as the
+// difference to the one before, the first frame stores it whole.
+func (l *Log) rebase(item *Item) error {
+	frame := make([]byte, item.length)
+	_, err := l.writer.ReadAt(frame, int64(item.offset))
+	if err != nil {
+		return err
+	}
+	size, n := binary.Uvarint(frame)
+	if n <= 0 {
+		return ErrInvalidData
+	}
+	_, m := binary.Uvarint(frame[n:])
+	if m <= 0 {
+		return ErrInvalidData
+	}
+	rest := frame[n+m : n+int(size)-ChecksumSize]
+	size = uint64(uvarintSize(item.index) + len(rest) + ChecksumSize)
+	b := make([]byte, 0, 2*uvarintSize(size)+int(size))
+	b = binary.AppendUvarint(b, size)
+	b = binary.AppendUvarint(b, item.index)
+	b = append(b, rest...)
+	b = binary.BigEndian.AppendUint32(b, compactSum(item.index, b))
+	b = appendReversedUvarint(b, size)
+	return l.writer.Replace(HeaderSize, int64(item.offset+item.length), b)
+}
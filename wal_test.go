@@ -1,15 +1,62 @@
 package wal
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	_ "github.com/stretchr/testify/assert"
 )
 
+// TestMain keeps the files of the tests out of the working directory.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "wal")
+	if err != nil {
+		panic(err)
+	}
+	testfile = filepath.Join(dir, testfile)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// tempLog opens a log in a new file of the test's temporary directory.
+func tempLog(t *testing.T, opts *Option) (*Log, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "wal")
+	return openLog(t, path, opts), path
+}
+
+// openLog opens the log at path and closes it when the test ends.
+func openLog(t *testing.T, path string, opts *Option) *Log {
+	t.Helper()
+	l, err := Open(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// writeTables appends the records of tables in index order.
+func writeTables(t *testing.T, l *Log) {
+	t.Helper()
+	for i := uint64(1); i <= uint64(len(tables)); i++ {
+		err := l.Write(tables[i].data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 func TestWalOpen(t *testing.T) {
 
 	os.RemoveAll(testfile)
@@ -30,8 +77,8 @@ func TestWalWrite(t *testing.T) {
 		t.Error(err)
 	}
 
-	for _, v := range tables {
-		err = l.Write(v.data)
+	for i := uint64(1); i <= uint64(len(tables)); i++ {
+		err = l.Write(tables[i].data)
 		assert.Equal(t, nil, err, "succeed")
 	}
 
@@ -44,8 +91,8 @@ func TestWalRead(t *testing.T) {
 		t.Error(err)
 	}
 
-	for _, v := range tables {
-		err = l.Write(v.data)
+	for i := uint64(1); i <= uint64(len(tables)); i++ {
+		err = l.Write(tables[i].data)
 		assert.Equal(t, nil, err, "succeed")
 	}
 
@@ -56,6 +103,33 @@ func TestWalRead(t *testing.T) {
 	}
 }
 
+func TestWalReadNotFound(t *testing.T) {
+	os.RemoveAll(testfile)
+	l, err := Open(testfile, nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = l.Read(1)
+	assert.Equal(t, ErrNotFound, err, "empty log")
+
+	for i := uint64(1); i <= uint64(len(tables)); i++ {
+		l.Write(tables[i].data)
+	}
+
+	_, err = l.Read(0)
+	assert.Equal(t, ErrNotFound, err, "index 0")
+	_, err = l.Read(uint64(len(tables)) + 1)
+	assert.Equal(t, ErrNotFound, err, "beyond last")
+
+	l.TruncateFront(3)
+	_, err = l.Read(2)
+	assert.Equal(t, ErrNotFound, err, "before first")
+	d, err := l.Read(3)
+	assert.Equal(t, nil, err, "first")
+	assert.Equal(t, tables[3].data, d, "first data")
+}
+
 func TestWalReadBatch(t *testing.T) {
 	os.RemoveAll(testfile)
 	l, err := Open(testfile, nil)
@@ -63,8 +137,8 @@ func TestWalReadBatch(t *testing.T) {
 		t.Error(err)
 	}
 
-	for _, v := range tables {
-		err = l.Write(v.data)
+	for i := uint64(1); i <= uint64(len(tables)); i++ {
+		err = l.Write(tables[i].data)
 		assert.Equal(t, nil, err, "succeed")
 	}
 
@@ -84,8 +158,8 @@ func TestWalTruncateFront(t *testing.T) {
 		t.Error(err)
 	}
 
-	for _, v := range tables {
-		l.Write(v.data)
+	for i := uint64(1); i <= uint64(len(tables)); i++ {
+		l.Write(tables[i].data)
 	}
 	items, err := l.writer.Items()
 	for _, v := range items {
@@ -102,3 +176,598 @@ func TestWalTruncateFront(t *testing.T) {
 		t.Logf("index: %d data: %s \n", v.index, d)
 	}
 }
+
+func TestWalReadRange(t *testing.T) {
+	l, _ := tempLog(t, nil)
+	writeTables(t, l)
+
+	data, next, err := l.ReadRange(2, 4, 0)
+	assert.Equal(t, nil, err, "no limit")
+	assert.Equal(t, [][]byte{tables[2].data, tables[3].data, tables[4].data}, data, "no limit")
+	assert.Equal(t, uint64(5), next, "no limit")
+
+	data, next, err = l.ReadRange(1, 100, len(tables[1].data)+len(tables[2].data))
+	assert.Equal(t, nil, err, "budget")
+	assert.Equal(t, [][]byte{tables[1].data, tables[2].data}, data, "budget")
+	assert.Equal(t, uint64(3), next, "budget")
+
+	data, next, err = l.ReadRange(3, 100, 1)
+	assert.Equal(t, nil, err, "oversized")
+	assert.Equal(t, [][]byte{tables[3].data}, data, "oversized")
+	assert.Equal(t, uint64(4), next, "oversized")
+
+	data, next, err = l.ReadRange(4, 100, 0)
+	assert.Equal(t, nil, err, "clamped")
+	assert.Equal(t, 2, len(data), "clamped")
+	assert.Equal(t, uint64(6), next, "clamped")
+
+	_, _, err = l.ReadRange(6, 10, 0)
+	assert.Equal(t, ErrNotFound, err, "beyond last")
+}
+
+func TestWalTruncateBack(t *testing.T) {
+	l, path := tempLog(t, nil)
+	writeTables(t, l)
+
+	err := l.TruncateBack(3)
+	assert.Equal(t, nil, err, "truncate back")
+	_, err = l.Read(4)
+	assert.Equal(t, ErrNotFound, err, "removed")
+
+	l.Write([]byte("new fourth"))
+	d, err := l.Read(4)
+	assert.Equal(t, nil, err, "rewritten")
+	assert.Equal(t, []byte("new fourth"), d, "rewritten")
+	l.Close()
+
+	l = openLog(t, path, nil)
+	assert.Equal(t, uint64(4), l.LastIndex(), "reopen")
+	d, err = l.Read(4)
+	assert.Equal(t, nil, err, "reopen")
+	assert.Equal(t, []byte("new fourth"), d, "reopen")
+
+	err = l.TruncateBack(0)
+	assert.Equal(t, nil, err, "truncate all")
+	items, _ := l.writer.Items()
+	assert.Equal(t, 0, len(items), "truncate all")
+}
+
+func TestWalTruncateBackRecover(t *testing.T) {
+	l, path := tempLog(t, nil)
+	writeTables(t, l)
+
+	// crash after the tail was committed but before the file was cut
+	h, _ := l.writer.Header()
+	h.tail = 2
+	l.writer.WriteAt(h.Marshal(), 0)
+	l.Close()
+
+	l = openLog(t, path, nil)
+	items, _ := l.writer.Items()
+	assert.Equal(t, 2, len(items), "recovered")
+	_, err := l.Read(3)
+	assert.Equal(t, ErrNotFound, err, "recovered")
+}
+
+func TestWalTornWrite(t *testing.T) {
+	// tear rewrites the log at path as if the frames from record idx on
+	// had only partly reached the disk while the header tail did
+	tear := func(t *testing.T, path string, idx uint64, fill byte) {
+		t.Helper()
+		l := openLog(t, path, &Option{ReadOnly: true, RefreshInterval: -1})
+		item, err := l.writer.Item(idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+		raw, _ := os.ReadFile(path)
+		for i := int(item.offset) + RecordSize + IndexSize + 2; i < len(raw); i++ {
+			raw[i] = fill
+		}
+		if err := os.WriteFile(path, raw, 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l, path := tempLog(t, nil)
+	writeTables(t, l)
+	l.Close()
+	tear(t, path, 4, 0xff)
+	l = openLog(t, path, nil)
+	assert.Equal(t, uint64(1), l.FirstIndex(), "first index")
+	assert.Equal(t, uint64(3), l.LastIndex(), "tail moved back")
+	item, _ := l.writer.Item(3)
+	assert.Equal(t, int64(item.offset+item.length), l.writer.Size(), "torn frames cut")
+	_, err := l.Read(4)
+	assert.Equal(t, ErrNotFound, err, "torn record")
+	assert.Equal(t, nil, l.Write([]byte("again")), "write after recovery")
+	l.Close()
+	l = openLog(t, path, nil)
+	assert.Equal(t, uint64(4), l.LastIndex(), "recovered tail committed")
+	data, _ := l.Read(4)
+	assert.Equal(t, []byte("again"), data, "written after recovery")
+	l.Close()
+
+	// the first records of an empty log
+	l, path = tempLog(t, nil)
+	writeTables(t, l)
+	l.Close()
+	tear(t, path, 1, 0)
+	l = openLog(t, path, nil)
+	assert.Equal(t, uint64(0), l.FirstIndex(), "emptied first index")
+	assert.Equal(t, uint64(0), l.LastIndex(), "emptied last index")
+	assert.Equal(t, int64(HeaderSize), l.writer.Size(), "all frames cut")
+	l.Write(tables[1].data)
+	assert.Equal(t, uint64(1), l.FirstIndex(), "written after recovery")
+
+	// a version 1 frame has no checksum, only its size shows a tear
+	l, path = tempLog(t, &Option{FormatVersion: formatV1})
+	writeTables(t, l)
+	l.Close()
+	tear(t, path, 5, 0)
+	l = openLog(t, path, nil)
+	assert.Equal(t, uint64(4), l.LastIndex(), "version 1 tail moved back")
+}
+
+func TestWalTruncateFrontCrash(t *testing.T) {
+	// crash rewrites the log at path as if TruncateFront(4) had been
+	// interrupted once the first move bytes of its data reached their
+	// place, with the journal of the move cut to journal bytes, -1 keeps
+	// all of it
+	crash := func(t *testing.T, path string, journal, move int) []byte {
+		t.Helper()
+		l := openLog(t, path, &Option{ReadOnly: true, RefreshInterval: -1})
+		item, err := l.writer.Item(4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+		raw, _ := os.ReadFile(path)
+		j := append([]byte(nil), raw[item.offset:]...)
+		tr := make([]byte, journalSize)
+		binary.BigEndian.PutUint64(tr, HeaderSize)
+		binary.BigEndian.PutUint64(tr[8:], uint64(len(j)))
+		binary.BigEndian.PutUint32(tr[16:], crc32.Checksum(j, crcTable))
+		binary.BigEndian.PutUint32(tr[20:], journalMagic)
+		j = append(j, tr...)
+		if journal < 0 {
+			journal = len(j)
+		}
+		raw = append(raw, j[:journal]...)
+		copy(raw[HeaderSize:], j[:move])
+		binary.BigEndian.PutUint32(raw[8:], binary.BigEndian.Uint32(raw[8:])|1)
+		os.WriteFile(path, raw, 0664)
+		return raw
+	}
+	write := func(t *testing.T) string {
+		t.Helper()
+		l, path := tempLog(t, nil)
+		for i := 1; i <= 8; i++ {
+			l.Write([]byte(fmt.Sprintf("record %d", i)))
+		}
+		l.Close()
+		return path
+	}
+	check := func(t *testing.T, l *Log, first uint64, msg string) {
+		t.Helper()
+		assert.Equal(t, first, l.FirstIndex(), msg)
+		assert.Equal(t, uint64(8), l.LastIndex(), msg)
+		for i := first; i <= 8; i++ {
+			data, err := l.Read(i)
+			assert.Equal(t, nil, err, msg)
+			assert.Equal(t, fmt.Sprintf("record %d", i), string(data), msg)
+		}
+		h, _ := l.writer.Header()
+		assert.Equal(t, uint32(0), h.gen&1, msg)
+	}
+
+	// the journal was synced, Open finishes the move
+	path := write(t)
+	crash(t, path, -1, 40)
+	l := openLog(t, path, nil)
+	check(t, l, 4, "move finished")
+	l.Close()
+	l = openLog(t, path, nil)
+	check(t, l, 4, "reopened")
+
+	// the journal is incomplete, the data was not moved yet
+	path = write(t)
+	raw := crash(t, path, 50, 0)
+	l = openLog(t, path, nil)
+	check(t, l, 1, "journal dropped")
+	assert.Equal(t, true, l.writer.Size() < int64(len(raw)), "journal dropped")
+
+	// data moved without a journal is beyond repair
+	path = write(t)
+	raw = crash(t, path, 0, 40)
+	_, err := Open(path, nil)
+	assert.Equal(t, ErrTorn, err, "torn below the tail")
+	after, _ := os.ReadFile(path)
+	assert.Equal(t, raw, after, "file untouched")
+}
+
+func TestWalWriteAt(t *testing.T) {
+	l, path := tempLog(t, nil)
+
+	err := l.WriteAt(0, []byte("zero"))
+	assert.Equal(t, ErrInvalidIndex, err, "index 0")
+
+	err = l.WriteAt(10000, []byte("base"))
+	assert.Equal(t, nil, err, "base index")
+	assert.Equal(t, uint64(10000), l.FirstIndex(), "base index")
+
+	err = l.WriteAt(10000, []byte("again"))
+	assert.Equal(t, ErrOutOfOrder, err, "same index")
+	err = l.WriteAt(9999, []byte("before"))
+	assert.Equal(t, ErrOutOfOrder, err, "smaller index")
+	err = l.WriteAt(10002, []byte("gap"))
+	assert.Equal(t, ErrIndexGap, err, "gap")
+
+	err = l.Write([]byte("next"))
+	assert.Equal(t, nil, err, "assigned index")
+	d, err := l.Read(10001)
+	assert.Equal(t, nil, err, "assigned index")
+	assert.Equal(t, []byte("next"), d, "assigned index")
+	l.Close()
+
+	l = openLog(t, path, &Option{AllowGaps: true})
+	assert.Equal(t, uint64(10000), l.FirstIndex(), "reopen")
+	err = l.WriteAt(10005, []byte("gap"))
+	assert.Equal(t, nil, err, "allowed gap")
+	_, err = l.Read(10003)
+	assert.Equal(t, ErrNotFound, err, "in the gap")
+	d, err = l.Read(10005)
+	assert.Equal(t, nil, err, "after the gap")
+	assert.Equal(t, []byte("gap"), d, "after the gap")
+}
+
+func TestWalFirstLastIndex(t *testing.T) {
+	var l IWal
+	l, _ = tempLog(t, nil)
+	assert.Equal(t, uint64(0), l.FirstIndex(), "empty")
+	assert.Equal(t, uint64(0), l.LastIndex(), "empty")
+
+	for i := uint64(1); i <= uint64(len(tables)); i++ {
+		l.Write(tables[i].data)
+	}
+	assert.Equal(t, uint64(1), l.FirstIndex(), "written")
+	assert.Equal(t, uint64(len(tables)), l.LastIndex(), "written")
+
+	l.TruncateFront(2)
+	l.TruncateBack(4)
+	assert.Equal(t, uint64(2), l.FirstIndex(), "truncated")
+	assert.Equal(t, uint64(4), l.LastIndex(), "truncated")
+}
+
+func TestWalContext(t *testing.T) {
+	l, _ := tempLog(t, nil)
+	ctx := context.Background()
+	for i := uint64(1); i <= uint64(len(tables)); i++ {
+		err := l.WriteContext(ctx, tables[i].data)
+		assert.Equal(t, nil, err, "write")
+	}
+	d, err := l.ReadContext(ctx, 3)
+	assert.Equal(t, nil, err, "read")
+	assert.Equal(t, tables[3].data, d, "read")
+
+	live, stop := context.WithCancel(ctx)
+	d, err = l.ReadContext(live, 4)
+	assert.Equal(t, nil, err, "cancellable read")
+	assert.Equal(t, tables[4].data, d, "cancellable read")
+	it := l.IteratorContext(live, 2, 3)
+	assert.Equal(t, true, it.Next(), "cancellable iterator")
+	stop()
+	assert.Equal(t, false, it.Next(), "cancelled iterator")
+	assert.Equal(t, context.Canceled, it.Err(), "cancelled iterator")
+
+	err = l.WriteContext(live, []byte("cancelled"))
+	assert.Equal(t, context.Canceled, err, "cancelled write")
+	assert.Equal(t, uint64(len(tables)), l.LastIndex(), "nothing written")
+	_, _, err = l.WriteBatchContext(live, &Batch{})
+	assert.Equal(t, context.Canceled, err, "cancelled batch")
+	_, err = l.ReadContext(live, 3)
+	assert.Equal(t, context.Canceled, err, "cancelled read")
+	_, _, err = l.ReadRangeContext(live, 1, 5, 0)
+	assert.Equal(t, context.Canceled, err, "cancelled range")
+	err = l.SyncContext(live)
+	assert.Equal(t, context.Canceled, err, "cancelled sync")
+	assert.Equal(t, context.Canceled, l.TruncateFrontContext(live, 2), "cancelled truncate")
+	assert.Equal(t, context.Canceled, l.TruncateBackContext(live, 2), "cancelled truncate back")
+	assert.Equal(t, context.Canceled, l.WriteAtContext(live, 9, nil), "cancelled write at")
+	err = l.WriteWithMetaContext(live, nil, map[string]string{"k": "v"})
+	assert.Equal(t, context.Canceled, err, "cancelled write with meta")
+	assert.Equal(t, context.Canceled, l.WriteTombstoneContext(live, 2), "cancelled tombstone")
+	_, err = l.ReadEntryContext(live, 3)
+	assert.Equal(t, context.Canceled, err, "cancelled entry")
+	var stream bytes.Buffer
+	l.Export(1, 2).WriteTo(&stream)
+	n, err := l.ImportContext(live, &stream)
+	assert.Equal(t, context.Canceled, err, "cancelled import")
+	assert.Equal(t, 0, n, "cancelled import")
+	assert.Equal(t, uint64(len(tables)), l.LastIndex(), "nothing written")
+
+	lease := l.Lease()
+	held, cancel := context.WithCancel(ctx)
+	go cancel()
+	assert.Equal(t, context.Canceled, l.TruncateFrontContext(held, 2), "lease held")
+	assert.Equal(t, uint64(1), l.FirstIndex(), "nothing truncated")
+	held, cancel = context.WithCancel(ctx)
+	go cancel()
+	assert.Equal(t, context.Canceled, l.TruncateBackContext(held, 2), "lease held")
+	assert.Equal(t, uint64(len(tables)), l.LastIndex(), "nothing truncated")
+	lease.Release()
+
+	d, err = l.Read(5)
+	assert.Equal(t, nil, err, "still readable")
+	assert.Equal(t, tables[5].data, d, "still readable")
+	assert.Equal(t, nil, l.TruncateFrontContext(ctx, 2), "truncate")
+	assert.Equal(t, uint64(2), l.FirstIndex(), "truncated")
+
+	// Close waits for the syncs that outlived their context
+	for i := 0; i < 10; i++ {
+		sctx, cancel := context.WithCancel(ctx)
+		go cancel()
+		l.SyncContext(sctx)
+	}
+	assert.Equal(t, nil, l.Close(), "close")
+	assert.Equal(t, ErrClosed, l.Sync(), "sync after close")
+}
+
+func TestWalConcurrent(t *testing.T) {
+	l, _ := tempLog(t, &Option{NoSync: true})
+
+	const writers, writes = 8, 100
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				if i%10 == 0 {
+					b := &Batch{}
+					b.Add([]byte(fmt.Sprintf("%d-%d", w, i)))
+					l.WriteBatch(b)
+					continue
+				}
+				l.Write([]byte(fmt.Sprintf("%d-%d", w, i)))
+			}
+		}(w)
+	}
+	stop := make(chan struct{})
+	var rg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		rg.Add(1)
+		go func() {
+			defer rg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				last := l.LastIndex()
+				if last > 0 {
+					d, err := l.Read(last)
+					assert.Equal(t, nil, err, "committed record")
+					assert.NotEqual(t, 0, len(d), "committed record")
+				}
+				var prev uint64
+				it := l.Iterator(1, last)
+				for it.Next() {
+					assert.Equal(t, prev+1, it.Index(), "no gaps")
+					prev = it.Index()
+				}
+				assert.Equal(t, nil, it.Err(), "iterate")
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	rg.Wait()
+
+	assert.Equal(t, uint64(writers*writes), l.LastIndex(), "every write got an index")
+	seen := make(map[string]bool)
+	it := l.Iterator(1, l.LastIndex())
+	for it.Next() {
+		seen[string(it.Value())] = true
+	}
+	assert.Equal(t, writers*writes, len(seen), "every write is stored once")
+}
+
+func TestWalConcurrentTruncate(t *testing.T) {
+	l, _ := tempLog(t, &Option{NoSync: true})
+	l.Write([]byte("1"))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 2; i <= 500; i++ {
+			l.Write([]byte(fmt.Sprint(i)))
+			if i%50 == 0 {
+				l.TruncateFront(uint64(i - 20))
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		last := l.LastIndex()
+		d, err := l.Read(last)
+		if err != ErrNotFound {
+			assert.Equal(t, nil, err, "read")
+			assert.Equal(t, fmt.Sprint(last), string(d), "read")
+		}
+		it := l.Iterator(l.FirstIndex(), last)
+		for it.Next() {
+			assert.Equal(t, fmt.Sprint(it.Index()), string(it.Value()), "iterate")
+		}
+		assert.Equal(t, nil, it.Err(), "iterate")
+	}
+}
+
+func TestWalReadDuringTruncate(t *testing.T) {
+	l, _ := tempLog(t, &Option{NoSync: true})
+	for i := 1; i <= 1000; i++ {
+		l.Write([]byte(fmt.Sprint(i)))
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				first, last := l.FirstIndex(), l.LastIndex()
+				idx := first + uint64(i*7+r)%(last-first+1)%16
+				d, err := l.Read(idx)
+				if err == ErrNotFound {
+					continue
+				}
+				assert.Equal(t, nil, err, "read")
+				assert.Equal(t, fmt.Sprint(idx), string(d), "data of the record read")
+				m, err := l.ReadBatch(idx, idx+1)
+				assert.Equal(t, nil, err, "read batch")
+				for k, v := range m {
+					assert.Equal(t, fmt.Sprint(k), string(v), "data of the batch")
+				}
+			}
+		}(r)
+	}
+	for i := uint64(2); i <= 600; i++ {
+		assert.Equal(t, nil, l.TruncateFront(i), "truncate front")
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestWalReadOnly(t *testing.T) {
+	w, path := tempLog(t, nil)
+	writeTables(t, w)
+	w.Close()
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := openLog(t, path, &Option{ReadOnly: true})
+	assert.Equal(t, ErrReadOnly, l.Write([]byte("x")), "write")
+	assert.Equal(t, ErrReadOnly, l.WriteAt(1, []byte("x")), "write at")
+	b := &Batch{}
+	b.Add([]byte("x"))
+	_, _, err = l.WriteBatch(b)
+	assert.Equal(t, ErrReadOnly, err, "write batch")
+	_, err = l.WriteAsync([]byte("x")).Wait()
+	assert.Equal(t, ErrReadOnly, err, "write async")
+	_, err = l.Import(strings.NewReader(""))
+	assert.Equal(t, ErrReadOnly, err, "import")
+	_, err = NewTypedLog[string](l, JSONCodec[string]{}).Append("x")
+	assert.Equal(t, ErrReadOnly, err, "typed append")
+	assert.Equal(t, ErrReadOnly, l.TruncateFront(2), "truncate front")
+	assert.Equal(t, ErrReadOnly, l.TruncateBack(2), "truncate back")
+	assert.Equal(t, nil, l.Sync(), "sync")
+
+	data, _, err := l.ReadRange(1, uint64(len(tables)), 0)
+	assert.Equal(t, nil, err, "read range")
+	for i, v := range data {
+		assert.Equal(t, tables[uint64(i)+1].data, v, "data")
+	}
+	l.Close()
+
+	after, _ := os.ReadFile(path)
+	assert.Equal(t, before, after, "file unchanged")
+}
+
+func TestWalTombstone(t *testing.T) {
+	l, _ := tempLog(t, nil)
+	writeTables(t, l)
+	assert.Equal(t, ErrNotFound, l.WriteTombstone(9), "unknown index")
+	assert.Equal(t, nil, l.WriteTombstone(2), "tombstone")
+	b := &Batch{}
+	b.Add([]byte("after"))
+	b.AddTombstone(3)
+	l.WriteBatch(b)
+
+	e, err := l.ReadEntry(6)
+	assert.Equal(t, nil, err, "read entry")
+	assert.Equal(t, RecordDel, e.Op, "op")
+	assert.Equal(t, uint64(2), binary.BigEndian.Uint64(e.Data), "deleted index")
+	e, _ = l.ReadEntry(2)
+	assert.Equal(t, RecordIns, e.Op, "deleted record stays")
+	assert.Equal(t, tables[2].data, e.Data, "deleted data")
+
+	ops := map[uint64]OpType{}
+	it := l.Iterator(1, 8)
+	for it.Next() {
+		ops[it.Index()] = it.Op()
+	}
+	assert.Equal(t, map[uint64]OpType{1: RecordIns, 2: RecordIns, 3: RecordIns, 4: RecordIns,
+		5: RecordIns, 6: RecordDel, 7: RecordIns, 8: RecordDel}, ops, "iterated ops")
+
+	stream := &bytes.Buffer{}
+	l.Export(5, 8).WriteTo(stream)
+	dst, _ := tempLog(t, nil)
+	dst.Import(stream)
+	e, _ = dst.ReadEntry(8)
+	assert.Equal(t, RecordDel, e.Op, "imported op")
+
+	// files written before record types existed stay readable and writable
+	path := filepath.Join(t.TempDir(), "v1")
+	err = os.WriteFile(path, (&header{version: formatV1, magic: defaultHeader.magic}).Marshal(), 0664)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = openLog(t, path, nil)
+	l.Write(tables[1].data)
+	assert.Equal(t, ErrOldFormat, l.WriteTombstone(1), "no tombstones")
+	l.Close()
+	l = openLog(t, path, nil)
+	e, _ = l.ReadEntry(1)
+	assert.Equal(t, tables[1].data, e.Data, "version 1 data")
+	assert.Equal(t, RecordIns, e.Op, "version 1 op")
+}
+
+func TestWalMeta(t *testing.T) {
+	l, _ := tempLog(t, nil)
+	meta := map[string]string{"producer": "p1", "trace": "abc"}
+	l.Write(tables[1].data)
+	size := l.writer.Size()
+	l.Write(tables[2].data)
+	assert.Equal(t, int64(frameSize(len(tables[2].data))), l.writer.Size()-size, "no space without attributes")
+	assert.Equal(t, nil, l.WriteWithMeta(tables[3].data, meta), "write with meta")
+	b := &Batch{}
+	b.AddWithMeta(tables[4].data, map[string]string{"schema": "2"})
+	l.WriteBatch(b)
+
+	e, err := l.ReadEntry(3)
+	assert.Equal(t, nil, err, "read entry")
+	assert.Equal(t, tables[3].data, e.Data, "payload unchanged")
+	assert.Equal(t, meta, e.Meta, "meta")
+	data, _ := l.Read(3)
+	assert.Equal(t, tables[3].data, data, "read")
+	e, _ = l.ReadEntry(2)
+	assert.Equal(t, map[string]string(nil), e.Meta, "no meta")
+
+	it := l.Iterator(4, 4)
+	it.Next()
+	assert.Equal(t, map[string]string{"schema": "2"}, it.Meta(), "iterator meta")
+
+	stream := &bytes.Buffer{}
+	l.Export(1, 4).WriteTo(stream)
+	dst, _ := tempLog(t, &Option{NoCopy: true})
+	n, err := dst.Import(stream)
+	assert.Equal(t, nil, err, "import")
+	assert.Equal(t, 4, n, "imported")
+	e, _ = dst.ReadEntry(3)
+	assert.Equal(t, meta, e.Meta, "imported meta")
+	assert.Equal(t, tables[3].data, e.Data, "imported payload")
+}